@@ -0,0 +1,230 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+)
+
+// floatImage holds the RGB channels of an image as floats, for arithmetic that would lose precision in 8 bits.
+type floatImage struct {
+	width  int
+	height int
+	pix    []float64
+}
+
+func newFloatImage(width, height int) *floatImage {
+	return &floatImage{
+		width:  width,
+		height: height,
+		pix:    make([]float64, width*height*3),
+	}
+}
+
+func floatImageFrom(img image.Image) *floatImage {
+	bounds := img.Bounds()
+	f := newFloatImage(bounds.Dx(), bounds.Dy())
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			c := rgbaToColorful(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+			i := (y*f.width + x) * 3
+			f.pix[i], f.pix[i+1], f.pix[i+2] = c.R, c.G, c.B
+		}
+	}
+
+	return f
+}
+
+func (f *floatImage) NRGBA() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, f.width, f.height))
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			i := (y*f.width + x) * 3
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: floatChannel(f.pix[i]),
+				G: floatChannel(f.pix[i+1]),
+				B: floatChannel(f.pix[i+2]),
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
+
+func floatChannel(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255))
+}
+
+// bilinear returns the interpolated channels at (x, y), which has to be inside the image.
+func (f *floatImage) bilinear(x, y float64) (c [3]float64) {
+	x0, y0 := int(x), int(y)
+	x1, y1 := x0+1, y0+1
+	if x1 >= f.width {
+		x1 = x0
+	}
+	if y1 >= f.height {
+		y1 = y0
+	}
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	for ch := 0; ch < 3; ch++ {
+		c00 := f.pix[(y0*f.width+x0)*3+ch]
+		c10 := f.pix[(y0*f.width+x1)*3+ch]
+		c01 := f.pix[(y1*f.width+x0)*3+ch]
+		c11 := f.pix[(y1*f.width+x1)*3+ch]
+		c[ch] = lerp(lerp(c00, c10, fx), lerp(c01, c11, fx), fy)
+	}
+
+	return c
+}
+
+// blur convolves the image with a separable gaussian kernel, repeating the pixels at the edges.
+func (f *floatImage) blur(sigma float64) *floatImage {
+	if sigma <= 0 {
+		return f
+	}
+
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+
+	horizontal := newFloatImage(f.width, f.height)
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			for k, w := range kernel {
+				src := (y*f.width + clamp(x+k-radius, f.width)) * 3
+				dst := (y*f.width + x) * 3
+				for ch := 0; ch < 3; ch++ {
+					horizontal.pix[dst+ch] += w * f.pix[src+ch]
+				}
+			}
+		}
+	}
+
+	res := newFloatImage(f.width, f.height)
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			for k, w := range kernel {
+				src := (clamp(y+k-radius, f.height)*f.width + x) * 3
+				dst := (y*f.width + x) * 3
+				for ch := 0; ch < 3; ch++ {
+					res.pix[dst+ch] += w * horizontal.pix[src+ch]
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+// backProject refines the super-resolution estimate with iterative back-projection (Irani & Peleg, 1991).
+// Every iteration simulates the observed low resolution frames from the estimate: it blurs the estimate with the point spread function,
+// and samples it at the centers of the low resolution pixels moved back to the reference by the motion of their frame, which decimates it by scale.
+// The residuals between the observed and the simulated pixels are spread back onto the estimate through the adjoint of the sampling and of the blur.
+// It returns the refined estimate and the root mean square residual of every iteration.
+// It reports the observed pixels of every frame back-projected, and stops after the current iteration when the context is canceled.
+func backProject(ctx context.Context, estimate image.Image, observed []image.Image, motionCorrection []Motion, scale float64, iterations int, step, psfSigma float64, progress *progressTracker) (*image.NRGBA, []float64) {
+	x := floatImageFrom(estimate)
+
+	frames := make([]*floatImage, len(observed))
+	for k := range observed {
+		frames[k] = floatImageFrom(observed[k])
+	}
+
+	residuals := make([]float64, 0, iterations)
+	for iteration := 0; iteration < iterations && ctx.Err() == nil; iteration++ {
+		simulated := x.blur(psfSigma)
+		correction := newFloatImage(x.width, x.height)
+		weight := make([]float64, x.width*x.height)
+
+		var sumSquares float64
+		var n int
+		for k, frame := range frames {
+			for v := 0; v < frame.height; v++ {
+				for u := 0; u < frame.width; u++ {
+					// Center of the low resolution pixel on the high resolution grid of its frame, then moved back to the reference.
+					px, py := motionCorrection[k].Inverse((float64(u)+0.5)*scale-0.5, (float64(v)+0.5)*scale-0.5)
+					if px < 0 || px > float64(x.width-1) || py < 0 || py > float64(x.height-1) {
+						continue
+					}
+
+					s := simulated.bilinear(px, py)
+					o := frame.pix[(v*frame.width+u)*3 : (v*frame.width+u)*3+3]
+					var r [3]float64
+					for ch := 0; ch < 3; ch++ {
+						r[ch] = o[ch] - s[ch]
+						sumSquares += r[ch] * r[ch]
+						n++
+					}
+
+					// The adjoint of the bilinear sampling spreads the residual onto the four pixels around the sample.
+					x0, y0 := int(px), int(py)
+					fx, fy := px-float64(x0), py-float64(y0)
+					for _, corner := range [4]struct {
+						x, y int
+						w    float64
+					}{
+						{x0, y0, (1 - fx) * (1 - fy)},
+						{x0 + 1, y0, fx * (1 - fy)},
+						{x0, y0 + 1, (1 - fx) * fy},
+						{x0 + 1, y0 + 1, fx * fy},
+					} {
+						if corner.w == 0 || corner.x >= x.width || corner.y >= x.height {
+							continue
+						}
+
+						i := corner.y*x.width + corner.x
+						for ch := 0; ch < 3; ch++ {
+							correction.pix[i*3+ch] += corner.w * r[ch]
+						}
+						weight[i] += corner.w
+					}
+				}
+			}
+			progress.addPixels(int64(frame.width * frame.height))
+		}
+
+		if n == 0 {
+			break
+		}
+		residuals = append(residuals, math.Sqrt(sumSquares/float64(n)))
+
+		for i, w := range weight {
+			if w == 0 {
+				continue
+			}
+
+			for ch := 0; ch < 3; ch++ {
+				correction.pix[i*3+ch] /= w
+			}
+		}
+
+		// The gaussian is symmetric, so it is its own adjoint.
+		correction = correction.blur(psfSigma)
+		for i := range x.pix {
+			x.pix[i] = math.Max(0, math.Min(1, x.pix[i]+step*correction.pix[i]))
+		}
+	}
+
+	return x.NRGBA(), residuals
+}
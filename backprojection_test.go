@@ -0,0 +1,74 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestBackProjection(t *testing.T) {
+	pattern := func(x, y float64) float64 {
+		return 0.5 + 0.2*math.Sin(x/3) + 0.2*math.Cos(y/4)*math.Sin((x+y)/5)
+	}
+
+	// Four low resolution frames of the pattern, shifted by half of a low resolution pixel.
+	const scale = 2
+	shifts := []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}}
+	observed := make([]image.Image, len(shifts))
+	motions := make([]Motion, len(shifts))
+	for k, shift := range shifts {
+		frame := image.NewNRGBA(image.Rect(0, 0, 48, 32))
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 48; x++ {
+				// Every low resolution pixel is the average of the scale*scale high resolution pixels it covers.
+				var v float64
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						v += pattern(float64(x*scale+dx-shift.X), float64(y*scale+dy-shift.Y))
+					}
+				}
+				g := floatChannel(v / scale / scale)
+				frame.Set(x, y, color.NRGBA{R: g, G: g, B: g, A: 255})
+			}
+		}
+		observed[k] = frame
+		motions[k] = Motion{X: shift.X, Y: shift.Y}
+	}
+
+	upscaled := make([]image.Image, len(observed))
+	for k := range observed {
+		upscaled[k] = imaging.Resize(observed[k], 96, 64, imaging.Gaussian)
+	}
+	estimate := superres(context.Background(), NewFrames(upscaled, 2), motions, nil, averageColor, bilinearInterpolation, 2, nil)
+
+	refined, residuals := backProject(context.Background(), estimate, observed, motions, scale, 10, 1.0, 1.0, nil)
+	if len(residuals) != 10 {
+		t.Fatalf("Expected a residual for every iteration, got %d", len(residuals))
+	}
+
+	if residuals[len(residuals)-1] >= residuals[0] {
+		t.Errorf("Residual should decrease, got %v", residuals)
+	}
+
+	groundTruthError := func(img *image.NRGBA) float64 {
+		var sum float64
+		var n int
+		for y := 4; y < 60; y++ {
+			for x := 4; x < 92; x++ {
+				d := float64(img.NRGBAAt(x, y).R)/255 - pattern(float64(x), float64(y))
+				sum += d * d
+				n++
+			}
+		}
+
+		return math.Sqrt(sum / float64(n))
+	}
+
+	if before, after := groundTruthError(estimate), groundTruthError(refined); after >= before {
+		t.Errorf("Back-projection should get closer to the ground truth, error before %f, after %f", before, after)
+	}
+}
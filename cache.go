@@ -0,0 +1,294 @@
+package superres
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Version of the cached motions, bump it whenever the registration changes in a way the cache keys don't capture.
+	motionCacheVersion = 3
+
+	motionCacheFile     = "motion.json"
+	motionCacheLockFile = "motion.lock"
+)
+
+// CacheModes lists the valid values of Options.CacheMode.
+var CacheModes = []string{"off", "read", "readwrite"}
+
+// cachedMotion is a motion in the cache, with the last time a run used it.
+type cachedMotion struct {
+	Motion   Motion
+	LastUsed time.Time
+}
+
+// MotionCache holds the motions estimated by earlier runs, keyed by the contents of the frames and every parameter of the registration (@see motionCacheKeys).
+// It is stored as a single JSON file in the cache directory, which concurrent runs share through a lock file.
+type MotionCache struct {
+	Version int
+	Entries map[string]cachedMotion
+}
+
+func newMotionCache() *MotionCache {
+	return &MotionCache{Version: motionCacheVersion, Entries: map[string]cachedMotion{}}
+}
+
+// defaultCacheDir returns the superres directory in the user's cache directory.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "superres")
+}
+
+// Get returns the cached motion of the key, a nil cache or an empty key never has one.
+func (mc *MotionCache) Get(key string) (Motion, bool) {
+	if mc == nil || key == "" {
+		return Motion{}, false
+	}
+
+	entry, found := mc.Entries[key]
+	if found {
+		entry.LastUsed = time.Now()
+		mc.Entries[key] = entry
+	}
+
+	return entry.Motion, found
+}
+
+// Put caches the motion under the key, a nil cache or an empty key doesn't keep it.
+func (mc *MotionCache) Put(key string, m Motion) {
+	if mc == nil || key == "" {
+		return
+	}
+
+	mc.Entries[key] = cachedMotion{Motion: m, LastUsed: time.Now()}
+}
+
+// readMotionCache reads the cache file of the directory.
+// A missing file or one written by another version is an empty cache, only a corrupt or unreadable file is an error.
+func readMotionCache(dir string) (*MotionCache, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, motionCacheFile))
+	if os.IsNotExist(err) {
+		return newMotionCache(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mc := newMotionCache()
+	if err := json.Unmarshal(buf, mc); err != nil {
+		return nil, fmt.Errorf("corrupt motion cache %s: %s", filepath.Join(dir, motionCacheFile), err)
+	}
+
+	if mc.Version != motionCacheVersion {
+		return newMotionCache(), nil
+	}
+
+	if mc.Entries == nil {
+		mc.Entries = map[string]cachedMotion{}
+	}
+
+	return mc, nil
+}
+
+// OpenMotionCache reads the cache of the directory under a shared lock.
+func OpenMotionCache(dir string) (*MotionCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockFile(filepath.Join(dir, motionCacheLockFile), false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return readMotionCache(dir)
+}
+
+// Save merges the entries into the cache file of the directory, keeping the entries other runs saved since this one read it.
+// It holds the lock exclusively while reading and writing the file, and replaces the file atomically, so readers never see it half written.
+func (mc *MotionCache) Save(dir string) error {
+	return updateMotionCache(dir, func(onDisk *MotionCache) {
+		for key, entry := range mc.Entries {
+			if existing, found := onDisk.Entries[key]; !found || existing.LastUsed.Before(entry.LastUsed) {
+				onDisk.Entries[key] = entry
+			}
+		}
+	})
+}
+
+// PruneMotionCache drops the cached motions unused for longer than maxAge, and returns how many it dropped and how many there were.
+func PruneMotionCache(dir string, maxAge time.Duration, now time.Time) (pruned, total int, err error) {
+	err = updateMotionCache(dir, func(onDisk *MotionCache) {
+		total = len(onDisk.Entries)
+		for key, entry := range onDisk.Entries {
+			if now.Sub(entry.LastUsed) > maxAge {
+				delete(onDisk.Entries, key)
+				pruned++
+			}
+		}
+	})
+
+	return pruned, total, err
+}
+
+// updateMotionCache reads, updates and writes back the cache file of the directory under the exclusive lock.
+func updateMotionCache(dir string, update func(*MotionCache)) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(filepath.Join(dir, motionCacheLockFile), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	onDisk, err := readMotionCache(dir)
+	if err != nil {
+		// A corrupt cache is only a cache, start over rather than failing every run.
+		onDisk = newMotionCache()
+	}
+
+	update(onDisk)
+
+	return writeFileAtomic(filepath.Join(dir, motionCacheFile), onDisk)
+}
+
+// writeFileAtomic writes the value as JSON to a temporary file next to the file, and renames it over the file.
+func writeFileAtomic(filename string, v interface{}) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// fileDigest returns the SHA-256 of the contents of the file.
+func fileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// registrationParameters are every setting the estimated motions depend on, next to the frames themselves.
+type registrationParameters struct {
+	Version       int
+	Frames        []string
+	Scale         float64
+	UpscaleFilter string
+	Transform     string
+	TileSize      int
+	Estimator     string
+	Sampler       string
+	Seed          int64
+	PyramidLevels int
+	SearchRange   float64
+	Chain         bool
+	Reanchor      int
+	Normalize     bool
+	HDR           bool
+}
+
+// motionCacheKeys returns the cache key of the motion of every frame relative to the first one, at the working scale.
+// A key hashes the contents of the reference and the frame, or of every frame from the reference to it when chaining, with the configured registration parameters.
+// The names are in the order of the pipeline, with the frame at reference swapped to the front (@see inputIndex).
+// The key of a frame that can't be read is empty, so its motion is never cached.
+func (o *Options) motionCacheKeys(imageNames []string, reference int, scale float64) []string {
+	digests := make([]string, len(imageNames))
+	for i := range imageNames {
+		digest, err := fileDigest(imageNames[i])
+		if err != nil {
+			o.verbosef("Not caching the motion of %s: %s\n", imageNames[i], err)
+			continue
+		}
+
+		digests[i] = digest
+	}
+
+	keys := make([]string, len(imageNames))
+	for i := 1; i < len(imageNames); i++ {
+		frames := []string{digests[0], digests[i]}
+		if o.Chain {
+			frames = nil
+			for _, k := range chainPath(reference, i) {
+				frames = append(frames, digests[k])
+			}
+		}
+
+		missing := false
+		for _, digest := range frames {
+			missing = missing || digest == ""
+		}
+		if missing {
+			continue
+		}
+
+		buf, _ := json.Marshal(registrationParameters{
+			Version:       motionCacheVersion,
+			Frames:        frames,
+			Scale:         scale,
+			UpscaleFilter: o.UpscaleFilter,
+			Transform:     o.Transform,
+			TileSize:      o.TileSize,
+			Estimator:     o.Estimator,
+			Sampler:       o.Sampler,
+			Seed:          o.Seed,
+			PyramidLevels: o.PyramidLevels,
+			SearchRange:   o.SearchRange,
+			Chain:         o.Chain,
+			Reanchor:      o.Reanchor,
+			Normalize:     o.Normalize,
+			HDR:           o.HDR,
+		})
+		sum := sha256.Sum256(buf)
+		keys[i] = hex.EncodeToString(sum[:])
+	}
+
+	return keys
+}
+
+// cacheKey returns the key of the frame, or an empty key without keys.
+func cacheKey(keys []string, i int) string {
+	if keys == nil {
+		return ""
+	}
+
+	return keys[i]
+}
@@ -0,0 +1,238 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMotionCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	mc, err := OpenMotionCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Motion{X: 3, Y: -2, SubX: 0.25, Diff: 0.01, Transform: &Transform{Model: "euclidean", Matrix: [9]float64{1, 0, 3, 0, 1, -2, 0, 0, 1}}}
+	mc.Put("key", m)
+	if err := mc.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenMotionCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, found := reopened.Get("key")
+	if !found || cached.X != m.X || cached.SubX != m.SubX || cached.Transform == nil || *cached.Transform != *m.Transform {
+		t.Errorf("Expected %s from the cache, got %s (found: %t)", m, cached, found)
+	}
+
+	if _, found := reopened.Get("other"); found {
+		t.Error("Unknown keys should not be found")
+	}
+
+	var nilCache *MotionCache
+	nilCache.Put("key", m)
+	if _, found := nilCache.Get("key"); found {
+		t.Error("A nil cache should never have a motion")
+	}
+}
+
+func TestMotionCacheConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every run opens the cache before the others saved, the saves should still keep every entry.
+	caches := make([]*MotionCache, 8)
+	for i := range caches {
+		var err error
+		if caches[i], err = OpenMotionCache(dir); err != nil {
+			t.Fatal(err)
+		}
+		caches[i].Put(strconv.Itoa(i), Motion{X: i})
+	}
+
+	var wg sync.WaitGroup
+	for i := range caches {
+		wg.Add(1)
+		go func(mc *MotionCache) {
+			defer wg.Done()
+			if err := mc.Save(dir); err != nil {
+				t.Error(err)
+			}
+		}(caches[i])
+	}
+	wg.Wait()
+
+	mc, err := OpenMotionCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range caches {
+		if m, found := mc.Get(strconv.Itoa(i)); !found || m.X != i {
+			t.Errorf("Entry %d was lost", i)
+		}
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+		t.Errorf("Temporary files should not be left behind: %v", matches)
+	}
+}
+
+func TestMotionCacheVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, motionCacheFile), []byte(`{"key": {"X": 1}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mc, err := OpenMotionCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mc.Entries) != 0 {
+		t.Error("A cache of another version should be discarded")
+	}
+}
+
+func TestMotionCacheCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, motionCacheFile), []byte(`{"Version": 2, "Entr`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMotionCache(dir); err == nil {
+		t.Error("Reading a corrupt cache should be an error")
+	}
+
+	mc := newMotionCache()
+	mc.Put("key", Motion{X: 1})
+	if err := mc.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened, err := OpenMotionCache(dir); err != nil || len(reopened.Entries) != 1 {
+		t.Errorf("Saving should replace a corrupt cache, got %v", err)
+	}
+}
+
+func TestGetMotionCorrectionCorruptCache(t *testing.T) {
+	bounds := image.Rect(0, 0, 96, 64)
+	shifts := []image.Point{{0, 0}, {2, 1}}
+	names := writeBurst(t, bounds, shifts)
+	imgs := make([]*Frame, len(shifts))
+	for i, shift := range shifts {
+		imgs[i] = asFrame(texture(bounds, float64(shift.X), float64(shift.Y)))
+	}
+
+	opts := testOptions()
+	opts.CacheMode, opts.CacheDir = "readwrite", t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(opts.CacheDir, motionCacheFile), []byte(`{"Version": 3, "Entr`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := opts.getMotionCorrection(context.Background(), names, imgs, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	mc, err := OpenMotionCache(opts.CacheDir)
+	if err != nil {
+		t.Fatalf("The run should replace the corrupt cache: %v", err)
+	}
+	if len(mc.Entries) != 1 {
+		t.Errorf("Expected the motion of the run in the cache, got %d entries", len(mc.Entries))
+	}
+}
+
+func TestPruneMotionCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	mc := newMotionCache()
+	mc.Entries["old"] = cachedMotion{Motion: Motion{X: 1}, LastUsed: now.Add(-48 * time.Hour)}
+	mc.Entries["new"] = cachedMotion{Motion: Motion{X: 2}, LastUsed: now.Add(-time.Hour)}
+	if err := mc.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, total, err := PruneMotionCache(dir, 24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned != 1 || total != 2 {
+		t.Errorf("Expected to prune 1 of 2 motions, pruned %d of %d", pruned, total)
+	}
+
+	reopened, err := OpenMotionCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := reopened.Get("old"); found {
+		t.Error("The old motion should be pruned")
+	}
+	if _, found := reopened.Get("new"); !found {
+		t.Error("The recent motion should be kept")
+	}
+}
+
+func TestMotionCacheKeys(t *testing.T) {
+	opts := DefaultOptions()
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	reference, first, second := write("reference", "a"), write("first", "b"), write("second", "c")
+	renamed := write("renamed", "b")
+
+	keys := opts.motionCacheKeys([]string{reference, first, second}, 0, 2)
+	if keys[0] != "" || keys[1] == "" || keys[1] == keys[2] {
+		t.Fatalf("Every frame but the reference should have its own key, got %v", keys)
+	}
+
+	if again := opts.motionCacheKeys([]string{reference, renamed}, 0, 2); again[1] != keys[1] {
+		t.Error("The key should only depend on the contents of the frames, not their names")
+	}
+
+	if scaled := opts.motionCacheKeys([]string{reference, first}, 0, 1); scaled[1] == keys[1] {
+		t.Error("The key should depend on the working scale")
+	}
+
+	opts.Transform = "affine"
+	if affine := opts.motionCacheKeys([]string{reference, first}, 0, 2); affine[1] == keys[1] {
+		t.Error("The key should depend on the transform model")
+	}
+	opts.Transform = "translation"
+
+	write("first", "changed")
+	if changed := opts.motionCacheKeys([]string{reference, first}, 0, 2); changed[1] == keys[1] {
+		t.Error("The key should change with the contents of the frame")
+	}
+
+	if missing := opts.motionCacheKeys([]string{reference, filepath.Join(dir, "missing")}, 0, 2); missing[1] != "" {
+		t.Error("Frames that can't be read should not be cached")
+	}
+
+	// Chained motions depend on every frame before them.
+	opts.Chain = true
+	chained := opts.motionCacheKeys([]string{reference, first, second}, 0, 2)
+	write("first", "b")
+	if rechained := opts.motionCacheKeys([]string{reference, first, second}, 0, 2); rechained[2] == chained[2] {
+		t.Error("A chained key should change with the frames before it")
+	}
+}
@@ -0,0 +1,127 @@
+package superres
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// Motion search radius in pixels around the chained motion when re-anchoring a frame against the reference.
+const anchorSearchRadius = 4
+
+// chainMotion registers every frame against its predecessor and composes the motions back to the reference.
+// The chain follows the order of the frames as given, outward from the reference in both directions (@see chainPredecessor).
+// The pairwise registrations run on the worker pool, the composition is sequential.
+// Every reanchor-th frame is registered against the reference around the composed motion, so the error of the chain does not accumulate.
+// It stops early when the context is canceled.
+func (o *Options) chainMotion(ctx context.Context, imgs []*Frame, motionCorrection []Motion, frames []int, reference int, progress *progressTracker) {
+	pairs := make([]Motion, len(imgs))
+	runMotionWorkers(ctx, o.workers(), frames, pairs, progress, func(i int) Motion {
+		return o.registerFrame(imgs[chainPredecessor(reference, i)], imgs[i])
+	})
+
+	// A frame is composed after its predecessor.
+	ordered := append([]int(nil), frames...)
+	sort.SliceStable(ordered, func(a, b int) bool {
+		return chainDistance(reference, ordered[a]) < chainDistance(reference, ordered[b])
+	})
+
+	for _, i := range ordered {
+		if ctx.Err() != nil {
+			return
+		}
+
+		motionCorrection[i] = composeMotion(motionCorrection[chainPredecessor(reference, i)], pairs[i])
+
+		if o.Reanchor > 0 && chainDistance(reference, i)%o.Reanchor == 0 {
+			motionCorrection[i] = o.anchorMotion(imgs[0], imgs[i], motionCorrection[i])
+		}
+	}
+}
+
+// chainPredecessor returns the frame the frame at i is registered against when chaining: its neighbour towards the reference in the order of the frames as given.
+// The frames are in the order of the pipeline, with the reference swapped to the front (@see inputIndex).
+func chainPredecessor(reference, i int) int {
+	given := inputIndex(reference, i)
+	if given > reference {
+		return inputIndex(reference, given-1)
+	}
+
+	return inputIndex(reference, given+1)
+}
+
+// chainDistance returns the number of registrations between the frame at i and the reference when chaining.
+func chainDistance(reference, i int) int {
+	d := inputIndex(reference, i) - reference
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
+
+// chainPath returns the frames from the reference to the frame at i when chaining.
+func chainPath(reference, i int) []int {
+	path := make([]int, chainDistance(reference, i)+1)
+	for k := len(path) - 1; k >= 0; k-- {
+		path[k] = i
+		if k > 0 {
+			i = chainPredecessor(reference, i)
+		}
+	}
+
+	return path
+}
+
+// composeMotion returns the motion of the first followed by the second.
+// The Diff of the result is the Diff of the second, the registration that was added to the chain.
+func composeMotion(first, second Motion) Motion {
+	firstX, firstY := first.Offset()
+	secondX, secondY := second.Offset()
+	x, y := firstX+secondX, firstY+secondY
+
+	m := Motion{
+		X:    int(math.Round(x)),
+		Y:    int(math.Round(y)),
+		Diff: second.Diff,
+	}
+	m.SubX, m.SubY = x-float64(m.X), y-float64(m.Y)
+
+	if first.Transform != nil || second.Transform != nil {
+		firstTransform, secondTransform := motionTransform(first), motionTransform(second)
+		m.Transform = &Transform{
+			Model:  second.Model(),
+			Matrix: multiplyMatrix(secondTransform.Matrix, firstTransform.Matrix),
+		}
+	}
+
+	return m
+}
+
+// motionTransform returns the global motion as a transform.
+func motionTransform(m Motion) Transform {
+	if m.Transform != nil {
+		return *m.Transform
+	}
+
+	x, y := m.Offset()
+	return Transform{Model: "translation", Matrix: [9]float64{1, 0, x, 0, 1, y, 0, 0, 1}}
+}
+
+// anchorMotion registers the candidate against the reference, searching only around the predicted motion.
+func (o *Options) anchorMotion(reference, candidate *Frame, predicted Motion) Motion {
+	smp := o.imageSampler(reference, ImageSamples)
+
+	m := refineMotion(reference, candidate, smp, spiralSearch(reference, candidate, smp, predicted.X, predicted.Y, anchorSearchRadius))
+
+	if o.Transform == "translation" {
+		return m
+	}
+
+	m, err := estimateTransform(reference, candidate, m, o.Transform)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
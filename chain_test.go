@@ -0,0 +1,105 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+)
+
+func TestComposeMotion(t *testing.T) {
+	m := composeMotion(Motion{X: 3, Y: -2, SubX: 0.25}, Motion{X: 4, Y: 1, SubX: 0.5, SubY: -0.25, Diff: 0.1})
+	if x, y := m.Offset(); x != 7.75 || y != -1.25 {
+		t.Errorf("Translations should add up, got %f %f", x, y)
+	}
+
+	if m.Diff != 0.1 {
+		t.Errorf("Composed motion should keep the Diff of the last registration, got %f", m.Diff)
+	}
+
+	bounds := image.Rect(0, 0, 640, 480)
+	rotation := normalizedTransform("euclidean", []float64{0, 0, 0.01}, bounds)
+	m = composeMotion(Motion{X: 5}, Motion{Transform: &rotation})
+	x, y := m.Apply(100, 100)
+	expectedX, expectedY := rotation.Apply(105, 100)
+	if math.Abs(x-expectedX) > 1e-9 || math.Abs(y-expectedY) > 1e-9 {
+		t.Errorf("Composed transform should apply the first motion first, got %f %f instead of %f %f", x, y, expectedX, expectedY)
+	}
+}
+
+func TestChainMotion(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Parallelism, opts.Transform, opts.Reanchor, opts.Sampler = 2, "translation", 3, "gauss"
+
+	// Every frame drifts 6 pixels further, so the last frames are out of the search range of the reference.
+	bounds := image.Rect(0, 0, 160, 120)
+	imgs := make([]image.Image, 6)
+	for i := range imgs {
+		img := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				fx, fy := float64(x-6*i), float64(y)
+				v := 2 + math.Sin(fx/7) + math.Cos(fy/9)*math.Sin((fx+fy)/13)
+				img.Pix[y*img.Stride+x] = uint8(v * 60)
+			}
+		}
+		imgs[i] = img
+	}
+
+	motionCorrection := make([]Motion, len(imgs))
+	opts.chainMotion(context.Background(), NewFrames(imgs, opts.Parallelism), motionCorrection, []int{1, 2, 3, 4, 5}, 0, nil)
+
+	for i := range motionCorrection {
+		if x, y := motionCorrection[i].Offset(); math.Abs(x-6*float64(i)) > 1 || math.Abs(y) > 1 {
+			t.Errorf("Frame %d: expected motion %d 0, got %s", i, 6*i, motionCorrection[i])
+		}
+	}
+}
+
+func TestChainMotionReference(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Parallelism, opts.Transform, opts.Reanchor, opts.Sampler = 2, "translation", 2, "gauss"
+
+	// Every frame drifts 6 pixels further, the reference is in the middle of the sequence.
+	const reference = 3
+	bounds := image.Rect(0, 0, 160, 120)
+	given := make([]image.Image, 6)
+	for i := range given {
+		img := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				fx, fy := float64(x-6*i), float64(y)
+				v := 2 + math.Sin(fx/7) + math.Cos(fy/9)*math.Sin((fx+fy)/13)
+				img.Pix[y*img.Stride+x] = uint8(v * 60)
+			}
+		}
+		given[i] = img
+	}
+
+	// The pipeline swaps the reference to the front.
+	imgs := make([]image.Image, len(given))
+	for i := range imgs {
+		imgs[i] = given[inputIndex(reference, i)]
+	}
+
+	// In the order of the pipeline the frames are 3, 1, 2, 0, 4, 5, each is chained to its neighbour towards frame 3.
+	for i, expected := range map[int]int{1: 2, 2: 0, 3: 1, 4: 0, 5: 4} {
+		if p := chainPredecessor(reference, i); p != expected {
+			t.Errorf("Frame %d should be chained to %d, got %d", i, expected, p)
+		}
+	}
+
+	if path := chainPath(reference, 3); len(path) != 4 || path[0] != 0 || path[1] != 2 || path[2] != 1 || path[3] != 3 {
+		t.Errorf("Frame 0 should be chained through frames 2 and 1, got %v", path)
+	}
+
+	motionCorrection := make([]Motion, len(imgs))
+	opts.chainMotion(context.Background(), NewFrames(imgs, opts.Parallelism), motionCorrection, []int{1, 2, 3, 4, 5}, reference, nil)
+
+	for i := range motionCorrection {
+		expected := 6 * float64(inputIndex(reference, i)-reference)
+		if x, y := motionCorrection[i].Offset(); math.Abs(x-expected) > 1 || math.Abs(y) > 1 {
+			t.Errorf("Frame %d: expected motion %.0f 0, got %s", inputIndex(reference, i), expected, motionCorrection[i])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/Coornail/superres"
+)
+
+// Cached motions unused for longer than this are dropped by cache prune.
+const defaultCacheMaxAge = 30 * 24 * time.Hour
+
+func main() {
+	go func() {
+		log.Println(http.ListenAndServe("localhost:6060", nil))
+	}()
+
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"cache": cacheCommand,
+			"serve": serveCommand,
+			"watch": watchCommand,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				panic(err)
+			}
+			return
+		}
+	}
+
+	opts := superres.DefaultOptions()
+	opts.Log = os.Stdout
+
+	var (
+		supersample bool
+		fast        bool
+		memoryLimit int
+		hdrOutput   string
+		outputFile  string
+		progress    bool
+		timeout     time.Duration
+	)
+
+	flag.BoolVar(&supersample, "supersample", true, "Supersample image, merge the images at -scale times the input resolution")
+	flag.Float64Var(&opts.Scale, "scale", opts.Scale, "Working resolution relative to the input when supersampling (1, 1.5, 2, 3, 4...)")
+	flag.Float64Var(&opts.OutputScale, "outputScale", opts.OutputScale, "Output resolution relative to the input")
+	flag.StringVar(&opts.UpscaleFilter, "upscaleFilter", opts.UpscaleFilter, fmt.Sprintf("Resampling filter to upscale the input images with (%s)", strings.Join(superres.FilterNames, ", ")))
+	flag.StringVar(&opts.OutputFilter, "outputFilter", opts.OutputFilter, fmt.Sprintf("Resampling filter to resize the output image with (%s)", strings.Join(superres.FilterNames, ", ")))
+	flag.BoolVar(&opts.Sharpen, "sharpen", opts.Sharpen, "Sharpen output image")
+	flag.BoolVar(&opts.Verbose, "verbose", opts.Verbose, "Verbose output")
+	flag.BoolVar(&fast, "fast", true, "Process images faster, trading quality: the gauss sampler without supersampling, unless -sampler or -scale is set")
+	flag.IntVar(&opts.Parallelism, "parallelism", opts.Parallelism, "Number of threads to download the articles")
+	flag.StringVar(&opts.MergeMethod, "mergeMethod", opts.MergeMethod, fmt.Sprintf("Method to merge pixels from the input images (%s)", strings.Join(superres.MergeMethods, ", ")))
+	flag.Float64Var(&opts.Kappa, "kappa", opts.Kappa, "Standard deviations to keep around the mean with the sigma merge method")
+	flag.IntVar(&opts.ClipIterations, "clipIterations", opts.ClipIterations, "Number of clipping iterations with the sigma merge method")
+	flag.Float64Var(&opts.TrimPercent, "trimPercent", opts.TrimPercent, "Percent of the highest and the lowest values to drop with the trimmed and winsorized merge methods")
+	flag.StringVar(&opts.Sampler, "sampler", opts.Sampler, fmt.Sprintf("Sample images for motion detection (%s)", strings.Join(superres.Samplers, ", ")))
+	flag.StringVar(&opts.Estimator, "estimator", opts.Estimator, fmt.Sprintf("Motion estimator (%s)", strings.Join(superres.EstimatorNames(), ", ")))
+	flag.Int64Var(&opts.Seed, "seed", opts.Seed, "Seed of the random samplers, the same seed and inputs always produce the same output")
+	flag.StringVar(&opts.Interpolation, "interpolation", opts.Interpolation, fmt.Sprintf("Interpolation used to sample the images at sub-pixel motion (%s)", strings.Join(superres.Interpolations, ", ")))
+	flag.StringVar(&opts.Transform, "transform", opts.Transform, "Transform model to align the images with (translation, euclidean, similarity, affine, homography)")
+	flag.IntVar(&opts.TileSize, "tileSize", opts.TileSize, "Size of the tiles to align locally, at least 16, 0 aligns the whole image")
+	flag.StringVar(&opts.TileDebug, "tileDebug", opts.TileDebug, "Directory to write the tile displacement fields to")
+	flag.IntVar(&opts.PyramidLevels, "pyramidLevels", opts.PyramidLevels, "Number of image pyramid levels for the coarse-to-fine motion search")
+	flag.Float64Var(&opts.SearchRange, "searchRange", opts.SearchRange, "Maximum motion to search for, as the ratio of the image size")
+	flag.StringVar(&opts.Reference, "reference", opts.Reference, "Reference frame to align the others to (first, sharpness, motion, an index or a file name)")
+	flag.BoolVar(&opts.Chain, "chain", opts.Chain, "Register every frame against its predecessor, for long drifting sequences")
+	flag.IntVar(&opts.Reanchor, "reanchor", opts.Reanchor, "Register every nth frame against the reference when chaining, to limit the accumulated error (0 disables)")
+	flag.IntVar(&opts.IBPIterations, "ibpIterations", opts.IBPIterations, "Number of iterative back-projection iterations to refine the merged image with (0 disables)")
+	flag.Float64Var(&opts.IBPStep, "ibpStep", opts.IBPStep, "Step size of the back-projected residuals")
+	flag.Float64Var(&opts.PSFSigma, "psfSigma", opts.PSFSigma, "Sigma of the gaussian point spread function used by the back-projection, in output pixels")
+	flag.BoolVar(&opts.Drizzle, "drizzle", opts.Drizzle, "Drizzle the frames onto the working resolution grid instead of upscaling them before the merge")
+	flag.Float64Var(&opts.DropSize, "dropSize", opts.DropSize, "Size of the drizzled drops relative to the input pixels")
+	flag.Float64Var(&opts.Deghost, "deghost", opts.Deghost, "Color distance (CIE94) to the reference above which the pixels of a frame are left out of the merge as moving objects (0 disables)")
+	flag.IntVar(&opts.GhostBlock, "ghostBlock", opts.GhostBlock, "Size in working pixels of the blocks compared to the reference when deghosting")
+	flag.IntVar(&opts.GhostDilation, "ghostDilation", opts.GhostDilation, "Number of blocks to grow the ghost masks by, to cover the edges of the moving objects")
+	flag.StringVar(&opts.GhostMaskDir, "ghostMasks", opts.GhostMaskDir, "Directory to write the ghost masks to")
+	flag.BoolVar(&opts.Normalize, "normalize", opts.Normalize, "Correct the exposure and white balance flicker of the frames against the reference with a gain and an offset per channel, before the alignment and the merge")
+	flag.BoolVar(&opts.HDR, "hdr", opts.HDR, "Merge an exposure-bracketed burst into a high dynamic range image, weighting the pixels by how well they are exposed instead of -mergeMethod")
+	flag.StringVar(&hdrOutput, "hdrOutput", "tonemap", fmt.Sprintf("Format of the HDR output (%s)", strings.Join(superres.HDROutputs, ", ")))
+	flag.StringVar(&opts.CacheMode, "cache", opts.CacheMode, fmt.Sprintf("Use of the motion cache (%s)", strings.Join(superres.CacheModes, ", ")))
+	flag.StringVar(&opts.CacheDir, "cacheDir", opts.CacheDir, "Directory of the motion cache")
+	flag.IntVar(&memoryLimit, "memoryLimit", 0, "Memory in MB the frames may take, larger bursts are merged in strips streamed from disk (0 disables)")
+	flag.StringVar(&outputFile, "output", "output.png", "Output file name")
+	flag.BoolVar(&progress, "progress", true, "Show a progress bar when the standard error is a terminal")
+	flag.DurationVar(&timeout, "timeout", 0, "Give up on the merge after this long (0 disables)")
+	flag.Parse()
+
+	// The flags set on the command line take precedence over -fast.
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if fast {
+		if !set["sampler"] {
+			opts.Sampler = "gauss"
+		}
+
+		if !set["supersample"] && !set["scale"] {
+			supersample = false
+		}
+	}
+
+	if !supersample {
+		opts.Scale = 1
+	}
+
+	opts.MemoryLimit = int64(memoryLimit) << 20
+
+	validHDROutput := false
+	for _, output := range superres.HDROutputs {
+		validHDROutput = validHDROutput || output == hdrOutput
+	}
+	if !validHDROutput {
+		panic(fmt.Sprintf("invalid HDR output %s, valid outputs are %s", hdrOutput, strings.Join(superres.HDROutputs, ", ")))
+	}
+
+	// The first interrupt stops the run cleanly, a second one kills it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if progress && isTerminal(os.Stderr) {
+		bar := newProgressBar(os.Stderr, opts.Log)
+		opts.Log, opts.OnProgress = bar, bar.Update
+		defer bar.Done()
+	}
+
+	result, err := superres.Process(ctx, flag.Args(), opts)
+	switch {
+	case errors.Is(err, context.Canceled):
+		fmt.Fprintln(os.Stderr, "\nInterrupted, no output written")
+		os.Exit(130)
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Fprintf(os.Stderr, "\nTimed out after %s, no output written\n", timeout)
+		os.Exit(1)
+	case err != nil:
+		panic(err)
+	}
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	// The 16-bit and float outputs keep the radiance as is.
+	if result.Radiance != nil && hdrOutput != "tonemap" {
+		err = result.Radiance.Encode(f, hdrOutput)
+	} else {
+		err = png.Encode(f, result.Image)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// cacheCommand runs the cache subcommand, cache prune drops the motions unused for longer than -maxAge.
+func cacheCommand(args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("unknown cache command %v, the only command is prune", args)
+	}
+
+	flags := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	dir := flags.String("cacheDir", superres.DefaultOptions().CacheDir, "Directory of the motion cache")
+	maxAge := flags.Duration("maxAge", defaultCacheMaxAge, "Drop the cached motions unused for longer than this (0 drops every motion)")
+	flags.Parse(args[1:])
+
+	pruned, total, err := superres.PruneMotionCache(*dir, *maxAge, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pruned %d of %d cached motions in %s\n", pruned, total, *dir)
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Coornail/superres"
+)
+
+const (
+	// Width of the bar in characters.
+	progressBarWidth = 30
+
+	// The bar is redrawn at most this often, besides at the start and the end of every stage.
+	progressRedraw = 100 * time.Millisecond
+)
+
+// progressBar draws the progress of the current stage on the last line of the terminal, with the time left of the stage.
+// It is also the log of the run, clearing the bar before every log message and drawing it again after, so the two don't mix.
+type progressBar struct {
+	mu  sync.Mutex
+	out io.Writer
+	log io.Writer
+
+	stage string
+	start time.Time
+	drawn time.Time
+	line  string
+}
+
+func newProgressBar(out, log io.Writer) *progressBar {
+	return &progressBar{out: out, log: log}
+}
+
+// Update draws the progress, it is the Options.OnProgress of the run.
+func (pb *progressBar) Update(p superres.Progress) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	now := time.Now()
+	if p.Stage != pb.stage {
+		pb.stage, pb.start = p.Stage, now
+	} else if now.Sub(pb.drawn) < progressRedraw && p.Fraction() < 1 {
+		return
+	}
+
+	pb.drawn = now
+	pb.line = progressLine(p, now.Sub(pb.start))
+	fmt.Fprintf(pb.out, "\r\033[K%s", pb.line)
+}
+
+// Write writes the log message above the bar.
+func (pb *progressBar) Write(b []byte) (int, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.line != "" {
+		fmt.Fprint(pb.out, "\r\033[K")
+	}
+
+	n, err := pb.log.Write(b)
+
+	if pb.line != "" {
+		fmt.Fprint(pb.out, pb.line)
+	}
+
+	return n, err
+}
+
+// Done clears the bar.
+func (pb *progressBar) Done() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if pb.line != "" {
+		fmt.Fprint(pb.out, "\r\033[K")
+		pb.line = ""
+	}
+}
+
+// progressLine renders the progress of the stage, estimating the time left from the time the stage took so far.
+func progressLine(p superres.Progress, elapsed time.Duration) string {
+	fraction := p.Fraction()
+	filled := int(fraction * progressBarWidth)
+
+	eta := "?"
+	if fraction >= 1 {
+		eta = "0s"
+	} else if fraction > 0 {
+		eta = time.Duration(float64(elapsed) * (1 - fraction) / fraction).Round(time.Second).String()
+	}
+
+	done := ""
+	if p.TotalFrames > 0 {
+		done = fmt.Sprintf(" %d/%d frames", p.Frames, p.TotalFrames)
+	}
+
+	return fmt.Sprintf("%-11s [%s%s] %3.0f%%%s ETA %s", p.Stage, strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), fraction*100, done, eta)
+}
+
+// isTerminal tells whether the file is a terminal, where the bar can redraw its line.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Coornail/superres"
+)
+
+// report describes how a burst was merged, it is written next to the output as JSON.
+type report struct {
+	Frames    []string
+	Reference string
+	Motions   []superres.Motion
+	Rejected  []string `json:",omitempty"`
+	Output    image.Rectangle
+	Stats     superres.Stats
+}
+
+// newReport describes the result of merging the named frames, by their base names.
+func newReport(frames []string, result *superres.Result) report {
+	r := report{
+		Reference: filepath.Base(frames[result.Reference]),
+		Motions:   result.Motions,
+		Output:    result.Image.Bounds(),
+		Stats:     result.Stats,
+	}
+
+	for _, frame := range frames {
+		r.Frames = append(r.Frames, filepath.Base(frame))
+	}
+
+	for _, i := range result.Rejected {
+		r.Rejected = append(r.Rejected, r.Frames[i])
+	}
+
+	return r
+}
+
+// process merges the frames, turning a panic of the merge into an error, so a bad burst fails alone instead of stopping the command.
+func process(ctx context.Context, frames []string, opts superres.Options) (result *superres.Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("merge panicked: %v", r)
+		}
+	}()
+
+	return superres.Process(ctx, frames, opts)
+}
+
+// writeOutput writes the merged image as PNG.
+func writeOutput(filename string, result *superres.Result) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(f, result.Image); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeReport writes the report as indented JSON.
+func writeReport(filename string, r report) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(buf, '\n'), 0644)
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Coornail/superres"
+)
+
+// States of a job, it goes from queued to running, and ends done, failed or canceled.
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+const (
+	// Files of a finished job, in its directory.
+	jobOutputFile = "output.png"
+	jobReportFile = "report.json"
+
+	// Largest option value read from a multipart upload.
+	maxOptionSize = 1 << 10
+)
+
+// serveCommand runs the serve subcommand, an HTTP service merging the uploaded bursts in the background.
+//
+//	POST   /jobs                  uploads a burst, as multipart/form-data or application/x-tar, the options are form or query values
+//	GET    /jobs                  lists the jobs
+//	GET    /jobs/{id}             returns the status and the progress of the job
+//	GET    /jobs/{id}/output.png  downloads the merged image of a done job
+//	GET    /jobs/{id}/report.json downloads the report of a done job
+//	DELETE /jobs/{id}             cancels the job and deletes its files
+//
+// The finished jobs and their files are deleted after -keep.
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:8080", "Address to listen on")
+	dir := flags.String("dir", "", "Directory to keep the uploaded bursts and the results in (default a temporary directory, deleted on exit)")
+	workers := flags.Int("workers", 1, "Number of bursts merged at once")
+	queue := flags.Int("queue", 16, "Number of bursts waiting to be merged, further uploads are refused until one starts")
+	parallelism := flags.Int("parallelism", runtime.NumCPU(), "Number of threads shared by the bursts merged at once")
+	maxUpload := flags.Int64("maxUpload", 1024, "Largest burst in MB accepted")
+	keep := flags.Duration("keep", 24*time.Hour, "Time the finished jobs and their results are kept (0 keeps them until deleted)")
+	cacheMode := flags.String("cache", "readwrite", fmt.Sprintf("Use of the motion cache (%s)", strings.Join(superres.CacheModes, ", ")))
+	cacheDir := flags.String("cacheDir", superres.DefaultOptions().CacheDir, "Directory of the motion cache")
+	flags.Parse(args)
+
+	if *workers < 1 {
+		return fmt.Errorf("invalid number of workers %d, at least one worker is needed", *workers)
+	}
+
+	if *dir == "" {
+		tmp, err := ioutil.TempDir("", "superres-serve")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+
+	// Every worker gets an equal share of the threads, so the bursts merged at once don't oversubscribe the machine.
+	opts := superres.DefaultOptions()
+	opts.Verbose = false
+	opts.CacheMode, opts.CacheDir = *cacheMode, *cacheDir
+	opts.Parallelism = *parallelism / *workers
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	s, err := newServer(*dir, opts, *workers, *queue)
+	if err != nil {
+		return err
+	}
+	s.maxUpload, s.retention = *maxUpload<<20, *keep
+
+	srv := &http.Server{Addr: *addr, Handler: s}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("Serving on http://%s/jobs with %d workers\n", *addr, *workers)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	// The running jobs are canceled, their uploads are left in the directory.
+	s.Close()
+
+	return nil
+}
+
+// server merges the bursts uploaded over HTTP.
+// The jobs wait in a bounded queue, a fixed number of workers take them one at a time.
+// The jobs are only kept in memory, until they are deleted, expire or the server stops.
+type server struct {
+	dir       string
+	opts      superres.Options
+	maxUpload int64
+	mux       *http.ServeMux
+
+	// retention is the time a finished job is kept after it finished, 0 keeps it until it's deleted.
+	retention time.Duration
+
+	queue   chan *job
+	workers sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	closed bool
+}
+
+// newServer starts the workers, the jobs are kept in dir and merged with opts, overridden by the options of the upload.
+func newServer(dir string, opts superres.Options, workers, queue int) (*server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		dir:       dir,
+		opts:      opts,
+		maxUpload: 1 << 30,
+		retention: 24 * time.Hour,
+		mux:       http.NewServeMux(),
+		queue:     make(chan *job, queue),
+		jobs:      make(map[string]*job),
+	}
+
+	s.mux.HandleFunc("/jobs", s.handleJobs)
+	s.mux.HandleFunc("/jobs/", s.handleJob)
+
+	for i := 0; i < workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+
+	return s, nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.expire(time.Now())
+	s.mux.ServeHTTP(w, r)
+}
+
+// expire deletes the jobs finished longer than the retention ago, with their files.
+func (s *server) expire(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, j := range s.jobs {
+		if finished := j.status().Finished; finished != nil && now.Sub(*finished) > s.retention {
+			delete(s.jobs, id)
+			j.discard()
+		}
+	}
+}
+
+// Close cancels every job and waits for the workers to stop.
+func (s *server) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+		for _, j := range s.jobs {
+			j.cancel()
+		}
+	}
+	s.mu.Unlock()
+
+	s.workers.Wait()
+}
+
+// work merges the queued jobs until the server is closed.
+func (s *server) work() {
+	defer s.workers.Done()
+
+	for j := range s.queue {
+		j.run()
+	}
+}
+
+// enqueue adds the job to the queue, unless it's full.
+func (s *server) enqueue(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.queue <- j:
+		s.jobs[j.id] = j
+		return true
+	default:
+		return false
+	}
+}
+
+// job returns the job by id, nil if there is no such job.
+func (s *server) job(id string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.jobs[id]
+}
+
+// handleJobs submits a burst or lists the jobs.
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.submit(w, r)
+
+	case http.MethodGet:
+		s.mu.Lock()
+		statuses := make([]jobStatus, 0, len(s.jobs))
+		for _, j := range s.jobs {
+			statuses = append(statuses, j.status())
+		}
+		s.mu.Unlock()
+
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Submitted.Before(statuses[j].Submitted)
+		})
+		writeJSON(w, http.StatusOK, statuses)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJob returns the status or the files of a job, or deletes it.
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, file := strings.TrimPrefix(r.URL.Path, "/jobs/"), ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, file = id[:i], id[i+1:]
+	}
+
+	j := s.job(id)
+	if j == nil || (file != "" && file != jobOutputFile && file != jobReportFile) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && file == "":
+		writeJSON(w, http.StatusOK, j.status())
+
+	case r.Method == http.MethodGet:
+		if state := j.status().State; state != jobDone {
+			http.Error(w, fmt.Sprintf("job %s is %s", id, state), http.StatusConflict)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(j.dir, file))
+
+	case r.Method == http.MethodDelete && file == "":
+		s.mu.Lock()
+		delete(s.jobs, id)
+		s.mu.Unlock()
+		j.discard()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// submit stores the uploaded burst and queues it.
+func (s *server) submit(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+
+	j, err := s.newJob()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	values := r.URL.Query()
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "multipart/form-data":
+		err = j.readMultipart(r, values)
+	case "application/x-tar":
+		err = j.readTar(r.Body)
+	default:
+		err = fmt.Errorf("unsupported content type %q, upload the frames as multipart/form-data or application/x-tar", contentType)
+	}
+
+	if err == nil && len(j.frames) == 0 {
+		err = errors.New("no frames uploaded")
+	}
+
+	if err == nil {
+		j.opts, err = jobOptions(s.opts, values)
+	}
+
+	if err != nil {
+		os.RemoveAll(j.dir)
+
+		code := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	if !s.enqueue(j) {
+		os.RemoveAll(j.dir)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "the queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Printf("Job %s: queued %d frames\n", j.id, len(j.frames))
+
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJSON(w, http.StatusAccepted, j.status())
+}
+
+// newJob creates an empty job with a random id and its directory.
+func (s *server) newJob() (*job, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		id:        hex.EncodeToString(id),
+		state:     jobQueued,
+		submitted: time.Now(),
+	}
+	j.dir = filepath.Join(s.dir, j.id)
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+
+	if err := os.MkdirAll(filepath.Join(j.dir, "frames"), 0755); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// jobOptions applies the options of an upload, named like the flags of the command line, to the options of the server.
+func jobOptions(opts superres.Options, values url.Values) (superres.Options, error) {
+	strs := map[string]*string{
+		"mergeMethod":   &opts.MergeMethod,
+		"sampler":       &opts.Sampler,
+		"estimator":     &opts.Estimator,
+		"transform":     &opts.Transform,
+		"interpolation": &opts.Interpolation,
+		"reference":     &opts.Reference,
+	}
+	floats := map[string]*float64{
+		"scale":       &opts.Scale,
+		"outputScale": &opts.OutputScale,
+		"kappa":       &opts.Kappa,
+		"trimPercent": &opts.TrimPercent,
+		"deghost":     &opts.Deghost,
+	}
+	bools := map[string]*bool{
+		"sharpen":   &opts.Sharpen,
+		"normalize": &opts.Normalize,
+		"drizzle":   &opts.Drizzle,
+		"hdr":       &opts.HDR,
+	}
+
+	for name := range values {
+		value := values.Get(name)
+
+		var err error
+		if p, ok := strs[name]; ok {
+			*p = value
+		} else if p, ok := floats[name]; ok {
+			*p, err = strconv.ParseFloat(value, 64)
+		} else if p, ok := bools[name]; ok {
+			*p, err = strconv.ParseBool(value)
+		} else {
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q", name, value)
+		}
+	}
+
+	return opts, opts.Validate()
+}
+
+// job is a burst to merge.
+type job struct {
+	id  string
+	dir string
+
+	// names are the uploaded file names of the frames, frames where they are stored.
+	names  []string
+	frames []string
+	opts   superres.Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	state     string
+	progress  superres.Progress
+	err       error
+	discarded bool
+	submitted time.Time
+	started   time.Time
+	finished  time.Time
+}
+
+// jobStatus is the status of a job, as returned by the service.
+type jobStatus struct {
+	ID     string
+	State  string
+	Frames []string
+
+	// Progress is the progress of the current stage, Fraction how much of it is done.
+	Progress superres.Progress
+	Fraction float64
+
+	Error     string `json:",omitempty"`
+	Submitted time.Time
+	Started   *time.Time `json:",omitempty"`
+	Finished  *time.Time `json:",omitempty"`
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	st := jobStatus{
+		ID:        j.id,
+		State:     j.state,
+		Frames:    j.names,
+		Progress:  j.progress,
+		Fraction:  j.progress.Fraction(),
+		Submitted: j.submitted,
+	}
+
+	if j.err != nil {
+		st.Error = j.err.Error()
+	}
+
+	if !j.started.IsZero() {
+		started := j.started
+		st.Started = &started
+	}
+
+	if !j.finished.IsZero() {
+		finished := j.finished
+		st.Finished = &finished
+	}
+
+	return st
+}
+
+// addFrame stores an uploaded frame, numbered to keep the order of the upload and tell apart the frames of the same name.
+func (j *job) addFrame(name string, r io.Reader) error {
+	filename := filepath.Join(j.dir, "frames", fmt.Sprintf("%03d-%s", len(j.frames), filepath.Base(name)))
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	j.names = append(j.names, filepath.Base(name))
+	j.frames = append(j.frames, filename)
+
+	return nil
+}
+
+// readMultipart stores the files of the form as the frames, and adds its other fields to the options.
+func (j *job) readMultipart(r *http.Request, values url.Values) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() != "" {
+			err = j.addFrame(part.FileName(), part)
+		} else if part.FormName() != "" {
+			var value []byte
+			value, err = ioutil.ReadAll(io.LimitReader(part, maxOptionSize))
+			values.Add(part.FormName(), string(value))
+		}
+		part.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readTar stores the regular files of the archive as the frames, in the order of the archive, skipping the hidden ones.
+func (j *job) readTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(filepath.Base(hdr.Name), ".") {
+			continue
+		}
+
+		if err := j.addFrame(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// run merges the burst, unless the job was canceled while queued, and keeps the output and the report.
+func (j *job) run() {
+	j.mu.Lock()
+	if j.ctx.Err() != nil {
+		j.state, j.err, j.finished = jobCanceled, j.ctx.Err(), time.Now()
+		j.mu.Unlock()
+		return
+	}
+	j.state, j.started = jobRunning, time.Now()
+	j.mu.Unlock()
+
+	// The frames are stored under numbered names, a reference by its uploaded name is the stored frame.
+	opts := j.opts
+	for i, name := range j.names {
+		if opts.Reference == name {
+			opts.Reference = j.frames[i]
+			break
+		}
+	}
+
+	opts.OnProgress = func(p superres.Progress) {
+		j.mu.Lock()
+		j.progress = p
+		j.mu.Unlock()
+	}
+
+	result, err := process(j.ctx, j.frames, opts)
+	if err == nil {
+		err = j.writeResult(result)
+	}
+
+	// The frames are not needed anymore.
+	os.RemoveAll(filepath.Join(j.dir, "frames"))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.err, j.finished = err, time.Now()
+	switch {
+	case err == nil:
+		j.state = jobDone
+		fmt.Printf("Job %s: done in %s\n", j.id, j.finished.Sub(j.started).Round(time.Millisecond))
+	case errors.Is(err, context.Canceled):
+		j.state = jobCanceled
+	default:
+		j.state = jobFailed
+		fmt.Printf("Job %s: failed: %s\n", j.id, err)
+	}
+
+	if j.discarded {
+		os.RemoveAll(j.dir)
+	}
+}
+
+// writeResult writes the output and the report of the job to its directory.
+func (j *job) writeResult(result *superres.Result) error {
+	if err := writeOutput(filepath.Join(j.dir, jobOutputFile), result); err != nil {
+		return err
+	}
+
+	return writeReport(filepath.Join(j.dir, jobReportFile), newReport(j.names, result))
+}
+
+// discard cancels the job and deletes its files, right away unless it's running, in which case the worker deletes them once it stops.
+func (j *job) discard() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.discarded = true
+	j.cancel()
+
+	if j.state != jobRunning {
+		os.RemoveAll(j.dir)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
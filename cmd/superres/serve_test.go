@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Coornail/superres"
+)
+
+// testFrames returns a burst of textured frames shifted by the offsets, encoded as PNG.
+func testFrames(t *testing.T, shifts ...image.Point) [][]byte {
+	var frames [][]byte
+	for _, shift := range shifts {
+		img := image.NewNRGBA(image.Rect(0, 0, 96, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 96; x++ {
+				fx, fy := float64(x-shift.X), float64(y-shift.Y)
+				img.Set(x, y, color.NRGBA{
+					R: uint8(127 + 120*math.Sin(fx/7)*math.Cos(fy/11)),
+					G: uint8(127 + 120*math.Cos(fy/5)),
+					B: uint8(127 + 120*math.Sin((fx+fy)/13)),
+					A: 255,
+				})
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, buf.Bytes())
+	}
+
+	return frames
+}
+
+// testServer starts a server merging without the motion cache, closed with the test.
+func testServer(t *testing.T, workers, queue int) (*server, *httptest.Server) {
+	opts := superres.DefaultOptions()
+	opts.CacheMode = "off"
+	opts.Sampler = "uniform"
+	opts.Verbose = false
+
+	s, err := newServer(t.TempDir(), opts, workers, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+
+	return s, ts
+}
+
+// submitMultipart uploads the frames with the options as form fields.
+func submitMultipart(t *testing.T, url string, frames [][]byte, options map[string]string) *http.Response {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range options {
+		mw.WriteField(name, value)
+	}
+	for i, frame := range frames {
+		fw, err := mw.CreateFormFile("frames", string(rune('a'+i))+".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(frame)
+	}
+	mw.Close()
+
+	resp, err := http.Post(url+"/jobs", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// waitJob polls the job until it's finished.
+func waitJob(t *testing.T, url string, resp *http.Response) jobStatus {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected the burst to be accepted, got %s: %s", resp.Status, msg)
+	}
+
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var st jobStatus
+		getJSON(t, url+resp.Header.Get("Location"), &st)
+		if st.State != jobQueued && st.State != jobRunning {
+			return st
+		}
+	}
+
+	t.Fatal("The job didn't finish in time")
+	return jobStatus{}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeMultipart(t *testing.T) {
+	_, ts := testServer(t, 1, 4)
+
+	resp := submitMultipart(t, ts.URL, testFrames(t, image.Point{}, image.Point{2, 1}, image.Point{-1, 2}), map[string]string{
+		"mergeMethod": "median",
+		"scale":       "1",
+		"sharpen":     "false",
+	})
+	st := waitJob(t, ts.URL, resp)
+	if st.State != jobDone {
+		t.Fatalf("Expected the job to be done, got %+v", st)
+	}
+	if st.Progress.Stage != superres.StageMerge || st.Fraction != 1 {
+		t.Errorf("A done job should report the end of the merge, got %+v", st)
+	}
+
+	out, err := http.Get(ts.URL + "/jobs/" + st.ID + "/" + jobOutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+	img, err := png.Decode(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 96, 64) {
+		t.Errorf("Expected the output at the input resolution, got %v", img.Bounds())
+	}
+
+	var r report
+	getJSON(t, ts.URL+"/jobs/"+st.ID+"/"+jobReportFile, &r)
+	if len(r.Frames) != 3 || r.Frames[0] != "a.png" || r.Reference != "a.png" || len(r.Motions) != 3 {
+		t.Errorf("Expected a report of the 3 uploaded frames, got %+v", r)
+	}
+	if x, y := r.Motions[1].Offset(); math.Abs(x-2) > 0.5 || math.Abs(y-1) > 0.5 {
+		t.Errorf("Expected the second frame to move by (2, 1), got %v", r.Motions[1])
+	}
+}
+
+func TestServeReferenceName(t *testing.T) {
+	_, ts := testServer(t, 1, 4)
+
+	resp := submitMultipart(t, ts.URL, testFrames(t, image.Point{}, image.Point{2, 1}, image.Point{-1, 2}), map[string]string{
+		"reference": "b.png",
+		"scale":     "1",
+	})
+	st := waitJob(t, ts.URL, resp)
+	if st.State != jobDone {
+		t.Fatalf("Expected the job to be done, got %+v", st)
+	}
+
+	var r report
+	getJSON(t, ts.URL+"/jobs/"+st.ID+"/"+jobReportFile, &r)
+	if r.Reference != "b.png" {
+		t.Errorf("Expected the uploaded frame b.png as the reference, got %s", r.Reference)
+	}
+}
+
+func TestServeExpire(t *testing.T) {
+	s, ts := testServer(t, 1, 4)
+	s.retention = time.Minute
+
+	st := waitJob(t, ts.URL, submitMultipart(t, ts.URL, testFrames(t, image.Point{}, image.Point{1, 0}), map[string]string{"scale": "1"}))
+	if st.State != jobDone {
+		t.Fatalf("Expected the job to be done, got %+v", st)
+	}
+
+	s.expire(time.Now())
+	if s.job(st.ID) == nil {
+		t.Fatal("A job finished within the retention should be kept")
+	}
+
+	s.expire(time.Now().Add(2 * time.Minute))
+	if s.job(st.ID) != nil {
+		t.Error("A job finished longer than the retention ago should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, st.ID)); !os.IsNotExist(err) {
+		t.Errorf("The files of an expired job should be deleted, got %v", err)
+	}
+}
+
+// panicWriter panics on every write.
+type panicWriter struct{}
+
+func (panicWriter) Write([]byte) (int, error) {
+	panic("write")
+}
+
+func TestServePanic(t *testing.T) {
+	s, ts := testServer(t, 1, 4)
+	s.opts.Log = panicWriter{}
+
+	st := waitJob(t, ts.URL, submitMultipart(t, ts.URL, testFrames(t, image.Point{}, image.Point{1, 0}), map[string]string{"scale": "1"}))
+	if st.State != jobFailed || !strings.Contains(st.Error, "panic") {
+		t.Errorf("A panicking merge should fail the job, got %+v", st)
+	}
+
+	s.opts.Log = nil
+	if st := waitJob(t, ts.URL, submitMultipart(t, ts.URL, testFrames(t, image.Point{}, image.Point{1, 0}), map[string]string{"scale": "1"})); st.State != jobDone {
+		t.Errorf("The server should keep merging after a panic, got %+v", st)
+	}
+}
+
+func TestServeTar(t *testing.T) {
+	_, ts := testServer(t, 1, 4)
+
+	var body bytes.Buffer
+	tw := tar.NewWriter(&body)
+	tw.WriteHeader(&tar.Header{Name: "burst/", Typeflag: tar.TypeDir, Mode: 0755})
+	for i, frame := range testFrames(t, image.Point{}, image.Point{1, 1}) {
+		tw.WriteHeader(&tar.Header{Name: "burst/" + string(rune('a'+i)) + ".png", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(frame))})
+		tw.Write(frame)
+	}
+	tw.WriteHeader(&tar.Header{Name: "burst/.DS_Store", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	tw.Write([]byte{0})
+	tw.Close()
+
+	resp, err := http.Post(ts.URL+"/jobs?scale=1&outputScale=0.5", "application/x-tar", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := waitJob(t, ts.URL, resp)
+	if st.State != jobDone || len(st.Frames) != 2 {
+		t.Fatalf("Expected the 2 frames of the archive to be merged, got %+v", st)
+	}
+
+	var r report
+	getJSON(t, ts.URL+"/jobs/"+st.ID+"/"+jobReportFile, &r)
+	if r.Output != image.Rect(0, 0, 48, 32) {
+		t.Errorf("Expected the output at half the input resolution, got %v", r.Output)
+	}
+}
+
+func TestServeInvalidUpload(t *testing.T) {
+	s, ts := testServer(t, 1, 4)
+	frames := testFrames(t, image.Point{}, image.Point{1, 0})
+
+	for name, options := range map[string]map[string]string{
+		"unknown option":       {"bogus": "1"},
+		"invalid value":        {"scale": "two"},
+		"invalid merge method": {"mergeMethod": "bogus"},
+	} {
+		resp := submitMultipart(t, ts.URL, frames, options)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %s", name, http.StatusBadRequest, resp.Status)
+		}
+	}
+
+	resp := submitMultipart(t, ts.URL, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("An upload without frames should be refused, got %s", resp.Status)
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("The refused uploads should be deleted, %d left", len(entries))
+	}
+}
+
+func TestServeQueueFull(t *testing.T) {
+	// Without workers nothing leaves the queue.
+	_, ts := testServer(t, 0, 1)
+	frames := testFrames(t, image.Point{}, image.Point{1, 0})
+
+	first := submitMultipart(t, ts.URL, frames, nil)
+	first.Body.Close()
+	if first.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected the first burst to be queued, got %s", first.Status)
+	}
+
+	second := submitMultipart(t, ts.URL, frames, nil)
+	second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a full queue to refuse the burst, got %s", second.Status)
+	}
+
+	// The queued job is canceled and forgotten.
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+first.Header.Get("Location"), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the job to be deleted, got %s", resp.Status)
+	}
+
+	resp, err = http.Get(ts.URL + first.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a deleted job to be gone, got %s", resp.Status)
+	}
+}
+
+func TestServeOutputNotReady(t *testing.T) {
+	_, ts := testServer(t, 0, 1)
+
+	resp := submitMultipart(t, ts.URL, testFrames(t, image.Point{}), nil)
+	resp.Body.Close()
+
+	out, err := http.Get(ts.URL + resp.Header.Get("Location") + "/" + jobOutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Body.Close()
+	if out.StatusCode != http.StatusConflict {
+		t.Errorf("The output of a queued job should not be served, got %s", out.Status)
+	}
+}
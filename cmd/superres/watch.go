@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Coornail/superres"
+)
+
+const (
+	// File of a failed burst with the error, in the moved burst directory.
+	burstErrorFile = "error.txt"
+
+	// File of the state of the watcher, in the output directory.
+	watchStateFile = ".superres-watch.json"
+)
+
+// presets are the named configurations of the watch subcommand, applied to the default options.
+var presets = map[string]func(*superres.Options){
+	"default": func(o *superres.Options) {},
+	"fast": func(o *superres.Options) {
+		o.Sampler = "gauss"
+		o.Scale = 1
+	},
+	"quality": func(o *superres.Options) {
+		o.MergeMethod = "sigma"
+		o.Interpolation = "bicubic"
+		o.IBPIterations = 5
+	},
+	"hdr": func(o *superres.Options) {
+		o.HDR = true
+	},
+}
+
+// watchCommand runs the watch subcommand, merging every burst directory dropped into the input directory once it's complete.
+// A burst is complete when its marker file shows up, or without a marker when none of its files changed for -quiet.
+// The output and the report are named after the burst, failed bursts are moved to the failed directory with the error.
+// The merged and the failed bursts are recorded in the output directory, so a restarted watcher doesn't merge them again.
+func watchCommand(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	in := flags.String("in", "", "Directory to watch for burst directories")
+	out := flags.String("out", "", "Directory to write the outputs and the reports to (default the input directory)")
+	failed := flags.String("failed", "", "Directory to move the failed bursts to (default failed in the input directory)")
+	marker := flags.String("marker", "", "File that marks a burst complete, instead of waiting for it to be quiet")
+	quiet := flags.Duration("quiet", 10*time.Second, "Time without changes after which a burst is complete, without -marker")
+	interval := flags.Duration("interval", 2*time.Second, "Time between two scans of the input directory")
+	preset := flags.String("preset", "default", fmt.Sprintf("Options of the merge, one of %s or a JSON file of options", strings.Join(presetNames(), ", ")))
+	flags.Parse(args)
+
+	if *in == "" {
+		return errors.New("the input directory is required, set -in")
+	}
+
+	opts, err := presetOptions(*preset)
+	if err != nil {
+		return err
+	}
+	opts.Log = os.Stdout
+	opts.Verbose = false
+
+	w, err := newWatcher(*in, *out, *failed, opts)
+	if err != nil {
+		return err
+	}
+	w.marker, w.quiet = *marker, *quiet
+
+	// An interrupted burst is not recorded, it is merged again on the next start.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Watching %s for bursts\n", w.in)
+	for {
+		if err := w.scan(ctx, time.Now()); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// presetOptions returns the options of the named preset, or read from the JSON file on top of the default options.
+func presetOptions(preset string) (superres.Options, error) {
+	opts := superres.DefaultOptions()
+
+	if apply, ok := presets[preset]; ok {
+		apply(&opts)
+	} else {
+		buf, err := ioutil.ReadFile(preset)
+		if err != nil {
+			return opts, fmt.Errorf("invalid preset %s, valid presets are %s or a JSON file of options: %w", preset, strings.Join(presetNames(), ", "), err)
+		}
+
+		if err := json.Unmarshal(buf, &opts); err != nil {
+			return opts, fmt.Errorf("invalid preset %s: %w", preset, err)
+		}
+	}
+
+	return opts, opts.Validate()
+}
+
+func presetNames() []string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// watcher merges the complete bursts of the input directory.
+type watcher struct {
+	in, out, failed string
+	marker          string
+	quiet           time.Duration
+	opts            superres.Options
+
+	state watchState
+}
+
+// watchState records the bursts merged or failed, by name.
+type watchState struct {
+	Bursts map[string]burstState
+}
+
+type burstState struct {
+	Failed   bool `json:",omitempty"`
+	Finished time.Time
+	Output   string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+
+	// MoveError is set when the failed burst couldn't be moved to the failed directory, it is left in the input directory.
+	MoveError string `json:",omitempty"`
+}
+
+// newWatcher creates the output and the failed directories, and reads the state of the previous runs.
+func newWatcher(in, out, failed string, opts superres.Options) (*watcher, error) {
+	if out == "" {
+		out = in
+	}
+
+	if failed == "" {
+		failed = filepath.Join(in, "failed")
+	}
+
+	w := &watcher{in: in, out: out, failed: failed, opts: opts, quiet: 10 * time.Second}
+
+	for _, dir := range []string{out, failed} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(out, watchStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &w.state); err != nil {
+			return nil, fmt.Errorf("corrupt watch state %s: %w", filepath.Join(out, watchStateFile), err)
+		}
+	}
+
+	if w.state.Bursts == nil {
+		w.state.Bursts = make(map[string]burstState)
+	}
+
+	return w, nil
+}
+
+// scan merges the complete bursts of the input directory that were not merged yet, one at a time.
+// It returns an error only if the state can't be saved, the errors of the bursts fail the burst.
+func (w *watcher) scan(ctx context.Context, now time.Time) error {
+	entries, err := ioutil.ReadDir(w.in)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(w.in, entry.Name())
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || sameDir(dir, w.out) || sameDir(dir, w.failed) {
+			continue
+		}
+
+		if st, ok := w.state.Bursts[entry.Name()]; ok && !st.Failed {
+			continue
+		}
+
+		frames, latest, complete, err := w.burst(dir, now)
+		if err != nil || !complete {
+			continue
+		}
+
+		// A failed burst left in the input directory is only merged again once it changes.
+		if st, ok := w.state.Bursts[entry.Name()]; ok && st.MoveError != "" && !latest.After(st.Finished) {
+			continue
+		}
+
+		if err := w.merge(ctx, entry.Name(), frames); err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// burst returns the frames of the burst directory, the time of its latest change, and whether the burst is complete.
+func (w *watcher) burst(dir string, now time.Time) (frames []string, latest time.Time, complete bool, err error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, latest, false, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, latest, false, err
+	}
+
+	latest, marked := info.ModTime(), false
+	for _, entry := range entries {
+		if entry.Name() == w.marker {
+			marked = true
+			continue
+		}
+
+		if entry.ModTime().After(latest) {
+			latest = entry.ModTime()
+		}
+
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".jpg", ".jpeg", ".png":
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				frames = append(frames, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	if w.marker != "" {
+		return frames, latest, marked, nil
+	}
+
+	return frames, latest, len(frames) > 0 && now.Sub(latest) >= w.quiet, nil
+}
+
+// merge merges the burst and records it.
+// A failed burst is moved to the failed directory with the error, an interrupted one is left as is.
+// A failed burst that can't be moved is recorded with the error of the move, and left in the input directory.
+func (w *watcher) merge(ctx context.Context, name string, frames []string) error {
+	fmt.Printf("Merging burst %s of %d frames\n", name, len(frames))
+
+	output := filepath.Join(w.out, name+".png")
+
+	err := errors.New("no frames in the burst")
+	var result *superres.Result
+	if len(frames) > 0 {
+		result, err = process(ctx, frames, w.opts)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	if err == nil {
+		err = writeBurstResult(output, filepath.Join(w.out, name+".json"), frames, result)
+	}
+
+	st := burstState{Finished: time.Now(), Output: output}
+	if err != nil {
+		fmt.Printf("Burst %s failed: %s\n", name, err)
+		st = burstState{Failed: true, Finished: time.Now(), Error: err.Error()}
+
+		if moveErr := w.moveFailed(name, err); moveErr != nil {
+			fmt.Printf("Burst %s could not be moved to %s: %s\n", name, w.failed, moveErr)
+			st.MoveError = moveErr.Error()
+		}
+	}
+
+	w.state.Bursts[name] = st
+
+	return w.saveState()
+}
+
+// writeBurstResult writes the output and the report through temporary files, so an interrupted write doesn't look finished.
+func writeBurstResult(output, reportFile string, frames []string, result *superres.Result) error {
+	if err := writeOutput(output+".tmp", result); err != nil {
+		os.Remove(output + ".tmp")
+		return err
+	}
+
+	if err := writeReport(reportFile+".tmp", newReport(frames, result)); err != nil {
+		os.Remove(output + ".tmp")
+		os.Remove(reportFile + ".tmp")
+		return err
+	}
+
+	if err := os.Rename(reportFile+".tmp", reportFile); err != nil {
+		return err
+	}
+
+	return os.Rename(output+".tmp", output)
+}
+
+// moveFailed moves the burst to the failed directory and writes the error next to its frames.
+// A burst failing again under the same name gets the time of the failure appended.
+func (w *watcher) moveFailed(name string, failure error) error {
+	target := filepath.Join(w.failed, name)
+	if _, err := os.Stat(target); err == nil {
+		target += "-" + time.Now().Format("20060102-150405")
+	}
+
+	if err := moveDir(filepath.Join(w.in, name), target); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(target, burstErrorFile), []byte(failure.Error()+"\n"), 0644)
+}
+
+// moveDir renames the directory, or copies and deletes it when the target is on another file system.
+func moveDir(source, target string) error {
+	err := os.Rename(source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyDir(source, target); err != nil {
+		os.RemoveAll(target)
+		return err
+	}
+
+	return os.RemoveAll(source)
+}
+
+// copyDir copies the directory with its files and subdirectories, keeping their permissions.
+func copyDir(source, target string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(target, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(dst, info.Mode().Perm())
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return copyFile(path, dst, info.Mode().Perm())
+	})
+}
+
+func copyFile(source, target string, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// saveState writes the state to a temporary file and renames it over the state file, so a crash never leaves it half written.
+func (w *watcher) saveState() error {
+	buf, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(w.out, watchStateFile)
+	if err := ioutil.WriteFile(filename+".tmp", append(buf, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// sameDir tells whether the two paths name the same directory.
+func sameDir(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	ib, err := os.Stat(b)
+
+	return err == nil && os.SameFile(ia, ib)
+}
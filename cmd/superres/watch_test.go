@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Coornail/superres"
+)
+
+// writeBurstDir writes the frames into a burst directory of the input directory.
+func writeBurstDir(t *testing.T, in, name string, frames [][]byte) {
+	dir := filepath.Join(in, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, frame := range frames {
+		if err := ioutil.WriteFile(filepath.Join(dir, string(rune('a'+i))+".png"), frame, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testWatcher returns a watcher of the directory merging without the motion cache.
+func testWatcher(t *testing.T, in string) *watcher {
+	opts, err := presetOptions("fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.CacheMode = "off"
+	opts.Verbose = false
+
+	w, err := newWatcher(in, "", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func TestWatchMarker(t *testing.T) {
+	in := t.TempDir()
+	frames := testFrames(t, image.Point{}, image.Point{1, 1})
+	writeBurstDir(t, in, "complete", frames)
+	writeBurstDir(t, in, "partial", frames)
+	ioutil.WriteFile(filepath.Join(in, "complete", "DONE"), nil, 0644)
+
+	w := testWatcher(t, in)
+	w.marker = "DONE"
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(in, "complete.png")); err != nil {
+		t.Errorf("Expected the marked burst to be merged next to it: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(in, "partial.png")); err == nil {
+		t.Error("The burst without the marker should not be merged")
+	}
+
+	var r report
+	buf, err := ioutil.ReadFile(filepath.Join(in, "complete.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Frames) != 2 || r.Frames[0] != "a.png" {
+		t.Errorf("Expected a report of the 2 frames without the marker, got %v", r.Frames)
+	}
+
+	// A restarted watcher remembers the merged burst.
+	os.Remove(filepath.Join(in, "complete.png"))
+	w = testWatcher(t, in)
+	w.marker = "DONE"
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(in, "complete.png")); err == nil {
+		t.Error("A merged burst should not be merged again after a restart")
+	}
+}
+
+func TestWatchQuiet(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	writeBurstDir(t, in, "burst", testFrames(t, image.Point{}, image.Point{1, 0}))
+
+	w := testWatcher(t, in)
+	w.out, w.quiet = out, time.Hour
+
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "burst.png")); err == nil {
+		t.Fatal("A burst changed within the quiet time should not be merged")
+	}
+
+	if err := w.scan(context.Background(), time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "burst.png")); err != nil {
+		t.Errorf("Expected the quiet burst to be merged to the output directory: %v", err)
+	}
+	if st := w.state.Bursts["burst"]; st.Failed || st.Output != filepath.Join(out, "burst.png") {
+		t.Errorf("Expected the burst to be recorded as merged, got %+v", st)
+	}
+}
+
+func TestWatchFailed(t *testing.T) {
+	in := t.TempDir()
+	writeBurstDir(t, in, "broken", [][]byte{[]byte("not an image")})
+
+	w := testWatcher(t, in)
+	w.quiet = 0
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(in, "broken")); err == nil {
+		t.Error("The failed burst should be moved out of the input directory")
+	}
+
+	msg, err := ioutil.ReadFile(filepath.Join(in, "failed", "broken", burstErrorFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.TrimSpace(string(msg))) == 0 {
+		t.Error("Expected the error of the burst next to its frames")
+	}
+
+	if st := w.state.Bursts["broken"]; !st.Failed || st.Error == "" {
+		t.Errorf("Expected the burst to be recorded as failed, got %+v", st)
+	}
+
+	// The failed directory is not a burst.
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.state.Bursts["failed"]; ok {
+		t.Error("The failed directory should not be merged")
+	}
+}
+
+func TestWatchPanic(t *testing.T) {
+	in := t.TempDir()
+	writeBurstDir(t, in, "burst", testFrames(t, image.Point{}, image.Point{1, 0}))
+
+	w := testWatcher(t, in)
+	w.quiet, w.opts.Log = 0, panicWriter{}
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := w.state.Bursts["burst"]; !st.Failed || !strings.Contains(st.Error, "panic") {
+		t.Errorf("A panicking merge should fail the burst, got %+v", st)
+	}
+	if _, err := os.Stat(filepath.Join(in, "failed", "burst", burstErrorFile)); err != nil {
+		t.Errorf("The panicking burst should be moved to the failed directory: %v", err)
+	}
+}
+
+func TestWatchMoveFailed(t *testing.T) {
+	in := t.TempDir()
+	writeBurstDir(t, in, "broken", [][]byte{[]byte("not an image")})
+
+	// The failed directory can't be created under a file.
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := testWatcher(t, in)
+	w.quiet, w.failed = 0, filepath.Join(blocker, "failed")
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatalf("A burst that can't be moved should not stop the watcher: %v", err)
+	}
+
+	st := w.state.Bursts["broken"]
+	if !st.Failed || st.Error == "" || st.MoveError == "" {
+		t.Errorf("Expected the burst to be recorded as failed with the error of the move, got %+v", st)
+	}
+	if _, err := os.Stat(filepath.Join(in, "broken")); err != nil {
+		t.Errorf("The burst should be left in the input directory: %v", err)
+	}
+
+	// The unchanged burst is not merged again.
+	if err := w.scan(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if w.state.Bursts["broken"].Finished != st.Finished {
+		t.Error("A failed burst left in place should only be merged again once it changes")
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	source, target := t.TempDir(), filepath.Join(t.TempDir(), "copy")
+	writeBurstDir(t, source, "sub", [][]byte{[]byte("frame")})
+
+	if err := copyDir(source, target); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(target, "sub", "a.png")); err != nil || string(buf) != "frame" {
+		t.Errorf("Expected the file copied with its directory, got %q: %v", buf, err)
+	}
+}
+
+func TestPresetOptions(t *testing.T) {
+	for _, name := range presetNames() {
+		if _, err := presetOptions(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "preset.json")
+	ioutil.WriteFile(file, []byte(`{"MergeMethod": "median", "Scale": 1}`), 0644)
+	opts, err := presetOptions(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MergeMethod != "median" || opts.Scale != 1 || opts.Sampler != superres.DefaultOptions().Sampler {
+		t.Errorf("Expected the preset file on top of the default options, got %+v", opts)
+	}
+
+	if _, err := presetOptions("bogus"); err == nil {
+		t.Error("An unknown preset should be refused")
+	}
+}
@@ -1,56 +1,215 @@
-package main
+package superres
 
 import (
 	"fmt"
 	"image/color"
 	"math"
 	"sort"
+	"strings"
 
 	colorful "github.com/lucasb-eyer/go-colorful"
 )
 
-type ColorMerge func([]colorful.Color) colorful.Color
+// LabColor is a color in CIE L*a*b*, the color space the frames are stored and merged in.
+type LabColor struct {
+	L, A, B float64
+}
+
+func labColor(c colorful.Color) LabColor {
+	l, a, b := c.Lab()
+
+	return LabColor{L: l, A: a, B: b}
+}
 
-func averageColor(colors []colorful.Color) colorful.Color {
+// Color converts the color to RGB, clamped to the displayable range.
+func (c LabColor) Color() colorful.Color {
+	return colorful.Lab(c.L, c.A, c.B).Clamped()
+}
+
+// ColorMerge merges the samples of a pixel into one color.
+type ColorMerge func([]LabColor) LabColor
+
+// MergeMethods lists the valid names of GetColorMerge.
+var MergeMethods = []string{"average", "median", "vectormedian", "sigma", "trimmed", "winsorized"}
+
+// GetColorMerge returns the merge method by name.
+// kappa and iterations configure the sigma clipped mean, percent the trimmed and winsorized means, out of range values are an error.
+func GetColorMerge(name string, kappa float64, iterations int, percent float64) (ColorMerge, error) {
+	switch name {
+	case "average":
+		return averageColor, nil
+	case "median":
+		return medianColor, nil
+	case "vectormedian":
+		return vectorMedianColor, nil
+	case "sigma":
+		if kappa <= 0 || iterations < 0 {
+			return nil, fmt.Errorf("invalid sigma clipping at %f sigma over %d iterations, kappa has to be positive and the iterations can't be negative", kappa, iterations)
+		}
+		return sigmaClippedColor(kappa, iterations), nil
+	case "trimmed", "winsorized":
+		if percent < 0 || percent >= 50 {
+			return nil, fmt.Errorf("invalid trim percent %f, it has to be at least 0 and below 50", percent)
+		}
+		if name == "trimmed" {
+			return trimmedColor(percent), nil
+		}
+		return winsorizedColor(percent), nil
+	default:
+		return nil, fmt.Errorf("unknown merge method %q, valid methods: %s", name, strings.Join(MergeMethods, ", "))
+	}
+}
+
+func averageColor(colors []LabColor) LabColor {
 	var l, a, b float64
 
 	for i := range colors {
-		currL, currA, currB := colors[i].Lab()
-		l += currL
-		a += currA
-		b += currB
+		l += colors[i].L
+		a += colors[i].A
+		b += colors[i].B
 	}
 
 	c := float64(len(colors))
 
-	return colorful.Lab(l/c, a/c, b/c).Clamped()
+	return LabColor{L: l / c, A: a / c, B: b / c}
 }
 
-func medianColor(colors []colorful.Color) colorful.Color {
-	c := len(colors)
-	if c == 1 {
+// medianColor returns the median of every Lab channel separately.
+func medianColor(colors []LabColor) LabColor {
+	if len(colors) == 1 {
 		return colors[0]
 	}
 
+	return channelColor(colors, median)
+}
+
+func median(values []float64) float64 {
+	sort.Float64s(values)
+
+	c := len(values)
+	if c%2 == 1 {
+		return values[c/2]
+	}
+
+	return (values[c/2] + values[c/2-1]) / 2.0
+}
+
+// vectorMedianColor returns the sample with the smallest summed distance to every other sample.
+// Unlike the per-channel median it always returns one of the input colors, so it never mixes channels of different samples.
+// CIE94 is not symmetric, so the distance of a pair is measured in both directions.
+func vectorMedianColor(colors []LabColor) LabColor {
+	dist := make([]float64, len(colors))
+	for i := range colors {
+		for j := i + 1; j < len(colors); j++ {
+			d := colors[i].distance(colors[j]) + colors[j].distance(colors[i])
+			dist[i] += d
+			dist[j] += d
+		}
+	}
+
+	best := 0
+	for i := range dist {
+		if dist[i] < dist[best] {
+			best = i
+		}
+	}
+
+	return colors[best]
+}
+
+// channelColor merges the colors by applying the estimator on each Lab channel separately.
+func channelColor(colors []LabColor, estimator func([]float64) float64) LabColor {
+	c := len(colors)
 	l := make([]float64, c)
 	a := make([]float64, c)
 	b := make([]float64, c)
 
 	for i := range colors {
-		l[i], a[i], b[i] = colors[i].Lab()
+		l[i], a[i], b[i] = colors[i].L, colors[i].A, colors[i].B
 	}
 
-	// How do I order colors? By luminoscence?
-	sort.Slice(colors, func(i, j int) bool {
-		return l[i] < l[j]
-	})
+	return LabColor{L: estimator(l), A: estimator(a), B: estimator(b)}
+}
 
-	if c%2 == 1 {
-		return colorful.Lab(l[c/2], a[c/2], b[c/2])
+// sigmaClippedColor returns the mean of the values within kappa standard deviations of the mean.
+// The clipping is repeated on the remaining values until nothing is rejected or for the given iterations.
+func sigmaClippedColor(kappa float64, iterations int) ColorMerge {
+	return func(colors []LabColor) LabColor {
+		return channelColor(colors, func(values []float64) float64 {
+			kept := values
+			for i := 0; i < iterations; i++ {
+				mean, deviation := meanDeviation(kept)
+
+				clipped := make([]float64, 0, len(kept))
+				for _, v := range kept {
+					if math.Abs(v-mean) <= kappa*deviation {
+						clipped = append(clipped, v)
+					}
+				}
+
+				if len(clipped) == len(kept) || len(clipped) == 0 {
+					break
+				}
+				kept = clipped
+			}
+
+			mean, _ := meanDeviation(kept)
+			return mean
+		})
+	}
+}
+
+// trimmedColor returns the mean of the values after dropping percent of the highest and the lowest values.
+func trimmedColor(percent float64) ColorMerge {
+	return func(colors []LabColor) LabColor {
+		return channelColor(colors, func(values []float64) float64 {
+			sort.Float64s(values)
+			trim := trimCount(len(values), percent)
+
+			mean, _ := meanDeviation(values[trim : len(values)-trim])
+			return mean
+		})
+	}
+}
+
+// winsorizedColor returns the mean of the values after replacing percent of the highest and the lowest values with the closest remaining one.
+func winsorizedColor(percent float64) ColorMerge {
+	return func(colors []LabColor) LabColor {
+		return channelColor(colors, func(values []float64) float64 {
+			sort.Float64s(values)
+			trim := trimCount(len(values), percent)
+			for i := 0; i < trim; i++ {
+				values[i] = values[trim]
+				values[len(values)-1-i] = values[len(values)-1-trim]
+			}
+
+			mean, _ := meanDeviation(values)
+			return mean
+		})
+	}
+}
+
+// trimCount returns how many values to drop from each end, always keeping at least one value.
+func trimCount(n int, percent float64) int {
+	trim := int(float64(n) * percent / 100)
+	if 2*trim >= n {
+		trim = (n - 1) / 2
+	}
+
+	return trim
+}
+
+func meanDeviation(values []float64) (mean, deviation float64) {
+	for _, v := range values {
+		mean += v
 	}
+	mean /= float64(len(values))
 
-	i := int(math.Floor(float64(c) / 2.0))
-	return colorful.Lab((l[i]+l[i-1])/2.0, (a[i]+a[i-1])/2.0, (b[i]+b[i-1])/2.0).Clamped()
+	for _, v := range values {
+		deviation += (v - mean) * (v - mean)
+	}
+
+	return mean, math.Sqrt(deviation / float64(len(values)))
 }
 
 func rgbaToColorful(c color.Color) colorful.Color {
@@ -73,29 +232,10 @@ func rgbaToColorful(c color.Color) colorful.Color {
 		res.B = 1.0
 	}
 
-	if !res.IsValid() {
-		fmt.Printf("%#v\n", res)
-		panic("invalid color")
-	}
-
 	return res
 }
 
-func distance(c1, c2 colorful.Color) float64 {
-	d := c1.DistanceCIE94(c2)
-	if math.IsNaN(d) {
-		fmt.Printf("%s + %s = %#v\n", c1.Hex(), c2.Hex(), d)
-		panic("Color distance is NaN")
-	}
-
-	// @todo why is this bigger than 1.0?
-	if d < -1.0 {
-		return -1.0
-	}
-
-	if d > 1.0 {
-		return 1.0
-	}
-
-	return d
+// distance is the CIE94 distance of the colors, which is not symmetric.
+func (c LabColor) distance(other LabColor) float64 {
+	return labDistance(c.L, c.A, c.B, other.L, other.A, other.B)
 }
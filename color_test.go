@@ -0,0 +1,144 @@
+package superres
+
+import (
+	"math"
+	"testing"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+// burst returns nine samples of the same gray with a single bright outlier, like a satellite or a hot pixel.
+func burst() []LabColor {
+	colors := make([]LabColor, 0, 10)
+	for i := 0; i < 9; i++ {
+		v := 0.4 + float64(i%3-1)*0.01
+		colors = append(colors, labColor(colorful.Color{R: v, G: v, B: v}))
+	}
+
+	return append(colors, labColor(colorful.Color{R: 1, G: 1, B: 1}))
+}
+
+func TestRobustMerge(t *testing.T) {
+	gray := colorful.Color{R: 0.4, G: 0.4, B: 0.4}
+
+	for _, name := range []string{"sigma", "trimmed", "winsorized"} {
+		merge, err := GetColorMerge(name, 2, 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := merge(burst()).Color().DistanceLab(gray); d > 0.01 {
+			t.Errorf("%s: outlier was not rejected, distance from the background %f", name, d)
+		}
+	}
+
+	if d := averageColor(burst()).Color().DistanceLab(gray); d < 0.01 {
+		t.Errorf("Average should not reject the outlier, distance from the background %f", d)
+	}
+}
+
+func TestTrimCount(t *testing.T) {
+	tests := []struct {
+		n       int
+		percent float64
+		trim    int
+	}{
+		{n: 10, percent: 10, trim: 1},
+		{n: 10, percent: 0, trim: 0},
+		{n: 3, percent: 50, trim: 1},
+		{n: 2, percent: 50, trim: 0},
+		{n: 1, percent: 90, trim: 0},
+	}
+
+	for _, test := range tests {
+		if trim := trimCount(test.n, test.percent); trim != test.trim {
+			t.Errorf("trimCount(%d, %f) = %d, expected %d", test.n, test.percent, trim, test.trim)
+		}
+	}
+}
+
+func TestMeanDeviation(t *testing.T) {
+	mean, deviation := meanDeviation([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+	if mean != 5 || math.Abs(deviation-2) > 1e-9 {
+		t.Errorf("Expected mean 5 and deviation 2, got %f %f", mean, deviation)
+	}
+}
+
+func TestUnknownMergeMethod(t *testing.T) {
+	if _, err := GetColorMerge("mean", 2, 3, 10); err == nil {
+		t.Errorf("Unknown merge method should return an error")
+	}
+}
+
+func TestInvalidMergeParameters(t *testing.T) {
+	invalid := map[string]struct {
+		method     string
+		kappa      float64
+		iterations int
+		percent    float64
+	}{
+		"kappa":      {"sigma", 0, 3, 10},
+		"iterations": {"sigma", 2, -1, 10},
+		"negative":   {"trimmed", 2, 3, -10},
+		"half":       {"winsorized", 2, 3, 50},
+	}
+
+	for name, p := range invalid {
+		if _, err := GetColorMerge(p.method, p.kappa, p.iterations, p.percent); err == nil {
+			t.Errorf("%s: invalid parameters should return an error", name)
+		}
+	}
+}
+
+// ghosted returns five samples of the background and two of a dark object passing through it.
+func ghosted() []LabColor {
+	background := labColor(colorful.Color{R: 0.8, G: 0.6, B: 0.2})
+	ghost := labColor(colorful.Color{R: 0.1, G: 0.1, B: 0.3})
+
+	return []LabColor{background, ghost, background, background, ghost, background, background}
+}
+
+func TestMedianRejectsGhost(t *testing.T) {
+	background := colorful.Color{R: 0.8, G: 0.6, B: 0.2}
+
+	for name, merge := range map[string]ColorMerge{"median": medianColor, "vectormedian": vectorMedianColor} {
+		if d := merge(ghosted()).Color().DistanceLab(background); d > 1e-6 {
+			t.Errorf("%s: ghost was not rejected, distance from the background %f", name, d)
+		}
+	}
+
+	if d := averageColor(ghosted()).Color().DistanceLab(background); d < 0.1 {
+		t.Errorf("Average should blend the ghost in, distance from the background %f", d)
+	}
+}
+
+func TestMedianChannels(t *testing.T) {
+	colors := []LabColor{
+		{L: 0.2, A: 0.1, B: -0.3},
+		{L: 0.9, A: -0.2, B: 0.1},
+		{L: 0.5, A: 0.0, B: 0.0},
+	}
+
+	m := medianColor(colors)
+	if math.Abs(m.L-0.5) > 1e-6 || math.Abs(m.A-0.0) > 1e-6 || math.Abs(m.B-0.0) > 1e-6 {
+		t.Errorf("Expected the median of every channel, got %f %f %f", m.L, m.A, m.B)
+	}
+
+	colors = append(colors, LabColor{L: 0.7, A: 0.1, B: 0.1})
+	m = medianColor(colors)
+	if math.Abs(m.L-0.6) > 1e-6 || math.Abs(m.A-0.05) > 1e-6 || math.Abs(m.B-0.05) > 1e-6 {
+		t.Errorf("Expected the mean of the middle values for even samples, got %f %f %f", m.L, m.A, m.B)
+	}
+}
+
+func TestVectorMedianReturnsSample(t *testing.T) {
+	colors := []LabColor{
+		labColor(colorful.Color{R: 0.5, G: 0.5, B: 0.5}),
+		labColor(colorful.Color{R: 0.55, G: 0.5, B: 0.45}),
+		labColor(colorful.Color{R: 0.0, G: 1.0, B: 0.0}),
+	}
+
+	if m := vectorMedianColor(colors); m != colors[0] && m != colors[1] {
+		t.Errorf("Vector median should return one of the central samples, got %#v", m)
+	}
+}
@@ -0,0 +1,71 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"math"
+)
+
+// drizzle merges the frames onto an output grid scale times finer than the input (Fruchter & Hook, 2002).
+// Every input pixel is shrunk to dropSize times its size, moved to the reference by the motion of its frame, and deposited onto the output pixels it overlaps, weighted by the overlapping area.
+// The motions are in input pixels. Output pixels that no drop reached are interpolated from the reference frame.
+// It reports every deposited frame, and stops early when the context is canceled, leaving the output incomplete.
+func drizzle(ctx context.Context, images []image.Image, motionCorrection []Motion, scale, dropSize float64, progress *progressTracker) *image.NRGBA {
+	bounds := images[0].Bounds()
+	width := int(math.Round(float64(bounds.Dx()) * scale))
+	height := int(math.Round(float64(bounds.Dy()) * scale))
+
+	sum := newFloatImage(width, height)
+	weight := make([]float64, width*height)
+
+	for k := 0; k < len(images) && ctx.Err() == nil; k++ {
+		frame := floatImageFrom(images[k])
+		for v := 0; v < frame.height; v++ {
+			for u := 0; u < frame.width; u++ {
+				px, py := motionCorrection[k].Inverse(float64(u), float64(v))
+
+				// Corners of the drop on the output grid, where output pixel j covers [j, j+1).
+				x0, x1 := (px+0.5-dropSize/2)*scale, (px+0.5+dropSize/2)*scale
+				y0, y1 := (py+0.5-dropSize/2)*scale, (py+0.5+dropSize/2)*scale
+
+				c := frame.pix[(v*frame.width+u)*3 : (v*frame.width+u)*3+3]
+				for oy := int(math.Max(0, math.Floor(y0))); oy < height && float64(oy) < y1; oy++ {
+					overlapY := math.Min(y1, float64(oy+1)) - math.Max(y0, float64(oy))
+					for ox := int(math.Max(0, math.Floor(x0))); ox < width && float64(ox) < x1; ox++ {
+						overlap := overlapY * (math.Min(x1, float64(ox+1)) - math.Max(x0, float64(ox)))
+						if overlap <= 0 {
+							continue
+						}
+
+						i := oy*width + ox
+						weight[i] += overlap
+						for ch := 0; ch < 3; ch++ {
+							sum.pix[i*3+ch] += overlap * c[ch]
+						}
+					}
+				}
+			}
+		}
+		progress.addFrames(1)
+	}
+
+	reference := floatImageFrom(images[0])
+	for oy := 0; oy < height; oy++ {
+		for ox := 0; ox < width; ox++ {
+			i := oy*width + ox
+			if weight[i] > 0 {
+				for ch := 0; ch < 3; ch++ {
+					sum.pix[i*3+ch] /= weight[i]
+				}
+				continue
+			}
+
+			rx := math.Max(0, math.Min(float64(reference.width-1), (float64(ox)+0.5)/scale-0.5))
+			ry := math.Max(0, math.Min(float64(reference.height-1), (float64(oy)+0.5)/scale-0.5))
+			c := reference.bilinear(rx, ry)
+			copy(sum.pix[i*3:i*3+3], c[:])
+		}
+	}
+
+	return sum.NRGBA()
+}
@@ -0,0 +1,44 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestDrizzle(t *testing.T) {
+	// Two frames of a vertical edge, the second shifted by half a pixel.
+	edge := func(shift float64) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, 8, 4))
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 8; x++ {
+				v := math.Max(0, math.Min(1, float64(x)+0.5-4-shift))
+				g := floatChannel(v)
+				img.Set(x, y, color.NRGBA{R: g, G: g, B: g, A: 255})
+			}
+		}
+
+		return img
+	}
+
+	frames := []image.Image{edge(0), edge(0.5)}
+	motions := []Motion{{}, {SubX: 0.5}}
+	output := drizzle(context.Background(), frames, motions, 2, 1, nil)
+
+	if bounds := output.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 8 {
+		t.Fatalf("Output should be twice the size of the input, got %v", bounds)
+	}
+
+	// The output should be monotonic across the edge, every pixel at least as bright as the one left of it.
+	for x := 1; x < 16; x++ {
+		if output.NRGBAAt(x, 4).R < output.NRGBAAt(x-1, 4).R {
+			t.Errorf("Output should be monotonic across the edge, pixel %d is darker than %d", x, x-1)
+		}
+	}
+
+	if output.NRGBAAt(0, 4).R != 0 || output.NRGBAAt(15, 4).R != 255 {
+		t.Errorf("Flat areas should keep their color, got %d and %d", output.NRGBAAt(0, 4).R, output.NRGBAAt(15, 4).R)
+	}
+}
@@ -0,0 +1,97 @@
+package superres
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultEstimator is the name of the motion estimator used unless configured otherwise.
+	DefaultEstimator = "spiral"
+
+	// DefaultSeed is the seed of the random samplers unless configured otherwise.
+	DefaultSeed = 1
+)
+
+// EstimatorOptions configures a motion estimator.
+// Estimators are free to ignore the options that don't apply to them.
+type EstimatorOptions struct {
+	// Sampler is the name of the sampler to choose the compared pixels with (@see NewSampler).
+	Sampler string
+
+	// PyramidLevels is the number of image pyramid levels for coarse-to-fine searches.
+	PyramidLevels int
+
+	// SearchRange is the maximum motion to search for, as the ratio of the image size.
+	SearchRange float64
+
+	// Seed of the random samplers.
+	Seed int64
+}
+
+// MotionEstimator finds the motion of the candidate image relative to the reference image.
+// The Diff of the returned motion is the confidence of the estimate, lower is better.
+type MotionEstimator interface {
+	Estimate(reference, candidate image.Image, options EstimatorOptions) Motion
+}
+
+// MotionEstimatorFunc adapts a function to the MotionEstimator interface.
+type MotionEstimatorFunc func(reference, candidate image.Image, options EstimatorOptions) Motion
+
+func (f MotionEstimatorFunc) Estimate(reference, candidate image.Image, options EstimatorOptions) Motion {
+	return f(reference, candidate, options)
+}
+
+var (
+	estimatorsMu sync.RWMutex
+	estimators   = make(map[string]MotionEstimator)
+)
+
+func init() {
+	RegisterEstimator("spiral", MotionEstimatorFunc(estimatePyramidMotion))
+	RegisterEstimator("phase", MotionEstimatorFunc(func(reference, candidate image.Image, _ EstimatorOptions) Motion {
+		return estimatePhaseCorrelation(reference, candidate)
+	}))
+}
+
+// RegisterEstimator makes a motion estimator available by name.
+// It panics if an estimator is already registered with the same name.
+func RegisterEstimator(name string, estimator MotionEstimator) {
+	estimatorsMu.Lock()
+	defer estimatorsMu.Unlock()
+
+	if _, found := estimators[name]; found {
+		panic(fmt.Sprintf("motion estimator %q is already registered", name))
+	}
+
+	estimators[name] = estimator
+}
+
+// GetEstimator returns the registered motion estimator by name.
+func GetEstimator(name string) (MotionEstimator, error) {
+	estimatorsMu.RLock()
+	estimator, found := estimators[name]
+	estimatorsMu.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("unknown motion estimator %q, valid estimators: %v", name, EstimatorNames())
+	}
+
+	return estimator, nil
+}
+
+// EstimatorNames returns the names of the registered motion estimators in alphabetical order.
+func EstimatorNames() []string {
+	estimatorsMu.RLock()
+	defer estimatorsMu.RUnlock()
+
+	names := make([]string, 0, len(estimators))
+	for name := range estimators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,70 @@
+package superres
+
+import (
+	"image"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestEstimators(t *testing.T) {
+	file1, _ := os.Open("motion_1.jpg")
+	defer file1.Close()
+	img1, _, err := image.Decode(file1)
+	if err != nil {
+		panic(err)
+	}
+
+	file2, _ := os.Open("motion_2.jpg")
+	defer file2.Close()
+	img2, _, err := image.Decode(file2)
+	if err != nil {
+		panic(err)
+	}
+
+	options := EstimatorOptions{
+		Sampler:       "gauss",
+		PyramidLevels: DefaultPyramidLevels,
+		SearchRange:   maxMotion,
+	}
+
+	tests := []struct {
+		name                 string
+		reference, candidate image.Image
+		x, y                 float64
+	}{
+		{name: "same image", reference: img1, candidate: img1, x: 0, y: 0},
+		{name: "example images", reference: img1, candidate: img2, x: 16, y: 22},
+	}
+
+	for _, name := range EstimatorNames() {
+		estimator, err := GetEstimator(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			m := estimator.Estimate(test.reference, test.candidate, options)
+			x, y := m.Offset()
+			if math.Abs(x-test.x) > 1 || math.Abs(y-test.y) > 1 {
+				t.Errorf("%s: %s: expected motion %.0f %.0f, got %s", name, test.name, test.x, test.y, m)
+			}
+		}
+	}
+}
+
+func TestUnknownEstimator(t *testing.T) {
+	if _, err := GetEstimator("unknown"); err == nil {
+		t.Errorf("Unknown estimator should return an error")
+	}
+}
+
+func TestRegisterEstimatorTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering an estimator twice should panic")
+		}
+	}()
+
+	RegisterEstimator(DefaultEstimator, MotionEstimatorFunc(estimatePyramidMotion))
+}
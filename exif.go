@@ -0,0 +1,188 @@
+package superres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	exifIFDPointerTag = 0x8769
+	exposureTimeTag   = 0x829a
+	fNumberTag        = 0x829d
+	isoSpeedTag       = 0x8827
+
+	exifShort    = 3
+	exifLong     = 4
+	exifRational = 5
+)
+
+var errNoExposure = errors.New("no exposure time in the EXIF data")
+
+// exifExposure is the exposure the camera recorded in the EXIF data of a JPEG.
+type exifExposure struct {
+	// Exposure time in seconds.
+	Time float64
+
+	// Aperture and sensitivity, 0 if the camera didn't record them.
+	FNumber float64
+	ISO     float64
+}
+
+// Relative returns the amount of light the exposure gathers, up to a constant: the exposure time times the sensitivity over the area of the aperture.
+func (e exifExposure) Relative() float64 {
+	res := e.Time
+	if e.FNumber > 0 {
+		res /= e.FNumber * e.FNumber
+	}
+	if e.ISO > 0 {
+		res *= e.ISO
+	}
+
+	return res
+}
+
+// readExposure reads the exposure from the EXIF data of a JPEG file.
+func readExposure(filename string) (exifExposure, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return exifExposure{}, err
+	}
+	defer f.Close()
+
+	tiff, err := exifSegment(bufio.NewReader(f))
+	if err != nil {
+		return exifExposure{}, err
+	}
+
+	return parseExposure(tiff)
+}
+
+// exifSegment returns the TIFF structure of the APP1 EXIF segment of a JPEG stream.
+func exifSegment(r io.Reader) ([]byte, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return nil, errors.New("not a JPEG file")
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoExposure
+		}
+
+		// The EXIF data comes before the image data, there is no point in looking further.
+		if header[0] != 0xff || header[1] == 0xda || header[1] == 0xd9 {
+			return nil, errNoExposure
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, errNoExposure
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExposure
+		}
+
+		if header[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// parseExposure finds the exposure tags in the EXIF sub-IFD of the TIFF structure.
+func parseExposure(tiff []byte) (exifExposure, error) {
+	if len(tiff) < 8 {
+		return exifExposure{}, errNoExposure
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exifExposure{}, errNoExposure
+	}
+
+	ifd0, ok := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if !ok {
+		return exifExposure{}, errNoExposure
+	}
+
+	pointer, ok := ifd0[exifIFDPointerTag]
+	if !ok {
+		return exifExposure{}, errNoExposure
+	}
+
+	exifIFD, ok := readIFD(tiff, order, order.Uint32(pointer.value[:]))
+	if !ok {
+		return exifExposure{}, errNoExposure
+	}
+
+	var res exifExposure
+	if res.Time, ok = exifIFD[exposureTimeTag].number(tiff, order); !ok || res.Time <= 0 {
+		return exifExposure{}, errNoExposure
+	}
+	res.FNumber, _ = exifIFD[fNumberTag].number(tiff, order)
+	res.ISO, _ = exifIFD[isoSpeedTag].number(tiff, order)
+
+	return res, nil
+}
+
+// ifdEntry is a tag of an image file directory, the value holds the value itself if it fits in 4 bytes or its offset otherwise.
+type ifdEntry struct {
+	kind  uint16
+	value [4]byte
+}
+
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) (map[uint16]ifdEntry, bool) {
+	if int64(offset)+2 > int64(len(tiff)) {
+		return nil, false
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	if int64(offset)+2+int64(count)*12 > int64(len(tiff)) {
+		return nil, false
+	}
+
+	entries := make(map[uint16]ifdEntry, count)
+	for i := 0; i < count; i++ {
+		e := tiff[int(offset)+2+i*12:]
+		entry := ifdEntry{kind: order.Uint16(e[2:])}
+		copy(entry.value[:], e[8:12])
+		entries[order.Uint16(e)] = entry
+	}
+
+	return entries, true
+}
+
+// number returns the numeric value of a short, long or rational entry.
+func (e ifdEntry) number(tiff []byte, order binary.ByteOrder) (float64, bool) {
+	switch e.kind {
+	case exifShort:
+		return float64(order.Uint16(e.value[:])), true
+	case exifLong:
+		return float64(order.Uint32(e.value[:])), true
+	case exifRational:
+		offset := int64(order.Uint32(e.value[:]))
+		if offset+8 > int64(len(tiff)) {
+			return 0, false
+		}
+
+		denominator := order.Uint32(tiff[offset+4:])
+		if denominator == 0 {
+			return 0, false
+		}
+
+		return float64(order.Uint32(tiff[offset:])) / float64(denominator), true
+	}
+
+	return 0, false
+}
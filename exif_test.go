@@ -0,0 +1,96 @@
+package superres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// exifJPEG returns a small JPEG with the exposure time, the aperture and the sensitivity in its EXIF data.
+func exifJPEG(order binary.ByteOrder, time, fNumber [2]uint32, iso uint16) []byte {
+	tiff := make([]byte, 84)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+
+	entry := func(offset int, tag, kind uint16, value uint32) {
+		order.PutUint16(tiff[offset:], tag)
+		order.PutUint16(tiff[offset+2:], kind)
+		order.PutUint32(tiff[offset+4:], 1)
+		if kind == exifShort {
+			order.PutUint16(tiff[offset+8:], uint16(value))
+		} else {
+			order.PutUint32(tiff[offset+8:], value)
+		}
+	}
+
+	// IFD0 only points to the EXIF IFD at 26, which has its rationals at 68 and 76.
+	order.PutUint16(tiff[8:], 1)
+	entry(10, exifIFDPointerTag, exifLong, 26)
+	order.PutUint16(tiff[26:], 3)
+	entry(28, exposureTimeTag, exifRational, 68)
+	entry(40, fNumberTag, exifRational, 76)
+	entry(52, isoSpeedTag, exifShort, uint32(iso))
+	order.PutUint32(tiff[68:], time[0])
+	order.PutUint32(tiff[72:], time[1])
+	order.PutUint32(tiff[76:], fNumber[0])
+	order.PutUint32(tiff[80:], fNumber[1])
+
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	var res bytes.Buffer
+	res.Write(img.Bytes()[:2])
+	res.Write([]byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)})
+	res.Write(segment)
+	res.Write(img.Bytes()[2:])
+
+	return res.Bytes()
+}
+
+func TestReadExposure(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		filename := filepath.Join(dir, order.String()+".jpg")
+		if err := ioutil.WriteFile(filename, exifJPEG(order, [2]uint32{1, 250}, [2]uint32{28, 10}, 400), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := readExposure(filename)
+		if err != nil {
+			t.Fatalf("%s: %s", order, err)
+		}
+
+		if e.Time != 1.0/250 || e.FNumber != 2.8 || e.ISO != 400 {
+			t.Errorf("%s: expected 1/250s at f/2.8 and ISO 400, got %+v", order, e)
+		}
+
+		if math.Abs(e.Relative()-400.0/250/2.8/2.8) > 1e-9 {
+			t.Errorf("%s: wrong relative exposure %f", order, e.Relative())
+		}
+	}
+}
+
+func TestReadExposureMissing(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "plain.jpg")
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err := ioutil.WriteFile(filename, img.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readExposure(filename); err != errNoExposure {
+		t.Errorf("A JPEG without EXIF data should have no exposure, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package superres
+
+import (
+	"math"
+	"math/bits"
+	"math/cmplx"
+)
+
+// fft transforms the data in place with the iterative radix-2 Cooley-Tukey algorithm.
+// The length of the data has to be a power of two. The inverse transform is scaled by 1/N.
+func fft(data []complex128, inverse bool) {
+	n := len(data)
+	if n <= 1 {
+		return
+	}
+
+	// Bit reversal permutation.
+	shift := 64 - uint(bits.TrailingZeros(uint(n)))
+	for i := 0; i < n; i++ {
+		j := int(bits.Reverse64(uint64(i)) >> shift)
+		if i < j {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1.0
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := data[start+k]
+				odd := data[start+k+size/2] * w
+				data[start+k] = even + odd
+				data[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+
+	if inverse {
+		scale := complex(1/float64(n), 0)
+		for i := range data {
+			data[i] *= scale
+		}
+	}
+}
+
+// fft2 transforms the row-major width*height data in place, first the rows then the columns.
+func fft2(data []complex128, width, height int, inverse bool) {
+	for y := 0; y < height; y++ {
+		fft(data[y*width:(y+1)*width], inverse)
+	}
+
+	column := make([]complex128, height)
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			column[y] = data[y*width+x]
+		}
+		fft(column, inverse)
+		for y := 0; y < height; y++ {
+			data[y*width+x] = column[y]
+		}
+	}
+}
+
+// nextPowerOfTwo returns the smallest power of two that is not smaller than n.
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+
+	return p
+}
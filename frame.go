@@ -0,0 +1,185 @@
+package superres
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+// Frame holds an image as planar CIE L*a*b* channels, converted once after decoding.
+// Comparing and merging colors happens in Lab, so the frame saves converting every pixel on every access.
+// It implements image.Image, so it can still be passed to anything expecting an image (samplers, resizing), at the cost of converting back.
+type Frame struct {
+	Rect image.Rectangle
+
+	// Channels of the pixels in row-major order, the pixel at (x, y) is at (y-Rect.Min.Y)*Rect.Dx() + (x-Rect.Min.X).
+	L []float32
+	A []float32
+	B []float32
+}
+
+// NewFrame converts the image to a frame.
+func NewFrame(img image.Image) *Frame {
+	bounds := img.Bounds()
+	f := &Frame{
+		Rect: bounds,
+		L:    make([]float32, bounds.Dx()*bounds.Dy()),
+		A:    make([]float32, bounds.Dx()*bounds.Dy()),
+		B:    make([]float32, bounds.Dx()*bounds.Dy()),
+	}
+
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			l, a, b := rgbaToColorful(img.At(x, y)).Lab()
+			f.L[i], f.A[i], f.B[i] = float32(l), float32(a), float32(b)
+			i++
+		}
+	}
+
+	return f
+}
+
+// NewFrames converts the images to frames on workers goroutines.
+func NewFrames(images []image.Image, workers int) []*Frame {
+	frames := make([]*Frame, len(images))
+	parallel(workers, len(images), func(i int) {
+		frames[i] = NewFrame(images[i])
+	})
+
+	return frames
+}
+
+// asFrame returns the image as a frame, only converting it if it isn't one already.
+func asFrame(img image.Image) *Frame {
+	if f, ok := img.(*Frame); ok {
+		return f
+	}
+
+	return NewFrame(img)
+}
+
+func (f *Frame) ColorModel() color.Model {
+	return color.NRGBA64Model
+}
+
+func (f *Frame) Bounds() image.Rectangle {
+	return f.Rect
+}
+
+// At converts the pixel back to RGB, prefer Lab and Color when working with frames.
+func (f *Frame) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(f.Rect) {
+		return color.NRGBA64{}
+	}
+
+	return f.Color(x, y)
+}
+
+func (f *Frame) offset(x, y int) int {
+	return (y-f.Rect.Min.Y)*f.Rect.Dx() + x - f.Rect.Min.X
+}
+
+// Lab returns the channels of the pixel, which has to be inside the frame.
+func (f *Frame) Lab(x, y int) (l, a, b float64) {
+	i := f.offset(x, y)
+
+	return float64(f.L[i]), float64(f.A[i]), float64(f.B[i])
+}
+
+// Color returns the color of the pixel, which has to be inside the frame.
+func (f *Frame) Color(x, y int) colorful.Color {
+	return colorful.Lab(f.Lab(x, y)).Clamped()
+}
+
+// clampedLab returns the channels of the closest pixel inside the frame.
+func (f *Frame) clampedLab(x, y int) (l, a, b float64) {
+	if x < f.Rect.Min.X {
+		x = f.Rect.Min.X
+	} else if x >= f.Rect.Max.X {
+		x = f.Rect.Max.X - 1
+	}
+
+	if y < f.Rect.Min.Y {
+		y = f.Rect.Min.Y
+	} else if y >= f.Rect.Max.Y {
+		y = f.Rect.Max.Y - 1
+	}
+
+	return f.Lab(x, y)
+}
+
+// Gray returns the lightness of the frame as an 8-bit grayscale image.
+// It is a cheap view of the frame for the code that works on the intensity of an image, like the edge detection of the samplers.
+func (f *Frame) Gray() *image.Gray {
+	img := image.NewGray(f.Rect)
+	for i, l := range f.L {
+		img.Pix[i] = uint8(math.Round(math.Max(0, math.Min(1, float64(l))) * 255))
+	}
+
+	return img
+}
+
+// half returns the frame downscaled by half, averaging every 2x2 block of pixels.
+func (f *Frame) half() *Frame {
+	width, height := f.Rect.Dx()/2, f.Rect.Dy()/2
+	h := &Frame{
+		Rect: image.Rect(0, 0, width, height),
+		L:    make([]float32, width*height),
+		A:    make([]float32, width*height),
+		B:    make([]float32, width*height),
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := f.offset(f.Rect.Min.X+2*x, f.Rect.Min.Y+2*y)
+			j := i + f.Rect.Dx()
+			k := y*width + x
+			h.L[k] = (f.L[i] + f.L[i+1] + f.L[j] + f.L[j+1]) / 4
+			h.A[k] = (f.A[i] + f.A[i+1] + f.A[j] + f.A[j+1]) / 4
+			h.B[k] = (f.B[i] + f.B[i+1] + f.B[j] + f.B[j+1]) / 4
+		}
+	}
+
+	return h
+}
+
+// labDistance is the CIE94 distance of two Lab colors, the same as colorful's DistanceCIE94 without converting the colors first.
+func labDistance(l1, a1, b1, l2, a2, b2 float64) float64 {
+	// The formula expects L, a and b 100 times larger than colorful has them.
+	l1, a1, b1 = l1*100, a1*100, b1*100
+	l2, a2, b2 = l2*100, a2*100, b2*100
+
+	const (
+		k1 = 0.045
+		k2 = 0.015
+	)
+
+	deltaL := l1 - l2
+	c1 := math.Sqrt(a1*a1 + b1*b1)
+	c2 := math.Sqrt(a2*a2 + b2*b2)
+	deltaC := c1 - c2
+	// The hue difference is only ever negative by rounding.
+	deltaH2 := math.Max(0, (a1-a2)*(a1-a2)+(b1-b2)*(b1-b2)-deltaC*deltaC)
+	sc := 1 + k1*c1
+	sh := 1 + k2*c1
+
+	d := math.Sqrt(deltaL*deltaL+deltaC*deltaC/(sc*sc)+deltaH2/(sh*sh)) * 0.01
+	// Colors that can't be compared are as far apart as possible.
+	if math.IsNaN(d) {
+		return 1.0
+	}
+
+	// @todo why is this bigger than 1.0?
+	if d < -1.0 {
+		return -1.0
+	}
+
+	if d > 1.0 {
+		return 1.0
+	}
+
+	return d
+}
@@ -0,0 +1,105 @@
+package superres
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"testing"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(3, 5, 35, 25))
+	for y := 5; y < 25; y++ {
+		for x := 3; x < 35; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 11), B: uint8(x * y), A: 255})
+		}
+	}
+
+	f := NewFrame(img)
+	if f.Bounds() != img.Bounds() {
+		t.Fatalf("Frame should keep the bounds %v, got %v", img.Bounds(), f.Bounds())
+	}
+
+	for y := 5; y < 25; y++ {
+		for x := 3; x < 35; x++ {
+			expected := img.NRGBAAt(x, y)
+			got := color.NRGBAModel.Convert(f.At(x, y)).(color.NRGBA)
+			if absDiff(expected.R, got.R) > 1 || absDiff(expected.G, got.G) > 1 || absDiff(expected.B, got.B) > 1 {
+				t.Errorf("Pixel %d %d should convert back to %v, got %v", x, y, expected, got)
+			}
+		}
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+
+	return int(b - a)
+}
+
+func TestLabDistance(t *testing.T) {
+	colors := []colorful.Color{{R: 0.1, G: 0.2, B: 0.3}, {R: 0.9, G: 0.1, B: 0.5}, {R: 0.5, G: 0.5, B: 0.5}, {R: 0, G: 1, B: 0}}
+	for _, c1 := range colors {
+		for _, c2 := range colors {
+			l1, a1, b1 := c1.Lab()
+			l2, a2, b2 := c2.Lab()
+			expected := math.Max(-1, math.Min(1, c1.DistanceCIE94(c2)))
+			if d := labDistance(l1, a1, b1, l2, a2, b2); math.Abs(d-expected) > 1e-12 {
+				t.Errorf("Distance of %s and %s should be %f, got %f", c1.Hex(), c2.Hex(), expected, d)
+			}
+		}
+	}
+	if d := labDistance(math.NaN(), 0, 0, 0.5, 0, 0); d != 1 {
+		t.Errorf("Colors that can't be compared should be as far apart as possible, got %f", d)
+	}
+}
+
+func TestFrameHalf(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 5, 4))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 10)
+	}
+
+	f := NewFrame(img)
+	h := f.half()
+	if h.Bounds().Dx() != 2 || h.Bounds().Dy() != 2 {
+		t.Fatalf("Half of 5x4 should be 2x2, got %v", h.Bounds())
+	}
+
+	l00, _, _ := f.Lab(2, 2)
+	l10, _, _ := f.Lab(3, 2)
+	l01, _, _ := f.Lab(2, 3)
+	l11, _, _ := f.Lab(3, 3)
+	if l, _, _ := h.Lab(1, 1); math.Abs(l-(l00+l10+l01+l11)/4) > 1e-6 {
+		t.Errorf("Pixel should be the average of its 2x2 block, got %f", l)
+	}
+}
+
+func BenchmarkEstimateMotion(b *testing.B) {
+	file1, _ := os.Open("motion_1.jpg")
+	defer file1.Close()
+	img1, _, err := image.Decode(file1)
+	if err != nil {
+		panic(err)
+	}
+
+	file2, _ := os.Open("motion_2.jpg")
+	defer file2.Close()
+	img2, _, err := image.Decode(file2)
+	if err != nil {
+		panic(err)
+	}
+
+	opts := DefaultOptions()
+	frames := NewFrames([]image.Image{img1, img2}, opts.Parallelism)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		opts.estimateMotion(frames[0], frames[1])
+	}
+}
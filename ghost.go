@@ -0,0 +1,142 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// GhostMask marks the blocks of a frame that differ too much from the reference to be merged, like people or cars moving through the burst.
+type GhostMask struct {
+	Bounds  image.Rectangle
+	Block   int
+	Columns int
+	Rows    int
+
+	// Rejected blocks in row-major order.
+	Mask []bool
+}
+
+// Rejected tells whether the pixel (x, y) of the reference is masked out, a nil mask rejects nothing.
+func (gm *GhostMask) Rejected(x, y int) bool {
+	if gm == nil || !image.Pt(x, y).In(gm.Bounds) {
+		return false
+	}
+
+	return gm.Mask[(y-gm.Bounds.Min.Y)/gm.Block*gm.Columns+(x-gm.Bounds.Min.X)/gm.Block]
+}
+
+func (gm *GhostMask) block(column, row int) image.Rectangle {
+	origin := gm.Bounds.Min.Add(image.Pt(column*gm.Block, row*gm.Block))
+
+	return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(gm.Block, gm.Block))}.Intersect(gm.Bounds)
+}
+
+// estimateGhostMasks estimates the ghost mask of every frame against the first one, the reference, which is never masked.
+// The motions are in working pixels. It stops early when the context is canceled, leaving the rest of the masks nil.
+func estimateGhostMasks(ctx context.Context, frames []*Frame, motionCorrection []Motion, interpolate Interpolator, threshold float64, block, dilation, workers int, progress *progressTracker) []*GhostMask {
+	masks := make([]*GhostMask, len(frames))
+	for i := 1; i < len(frames) && ctx.Err() == nil; i++ {
+		masks[i] = estimateGhostMask(frames[0], frames[i], motionCorrection[i], interpolate, threshold, block, dilation, workers)
+		progress.addFrames(1)
+	}
+
+	return masks
+}
+
+// estimateGhostMask compares the frame moved by the motion to the reference block by block.
+// Blocks whose mean color distance is above the threshold are rejected, then the rejection grows by dilation blocks in every direction to cover the edges of the moving objects.
+func estimateGhostMask(reference, frame *Frame, m Motion, interpolate Interpolator, threshold float64, block, dilation, workers int) *GhostMask {
+	bounds := reference.Rect
+	gm := &GhostMask{
+		Bounds:  bounds,
+		Block:   block,
+		Columns: (bounds.Dx() + block - 1) / block,
+		Rows:    (bounds.Dy() + block - 1) / block,
+	}
+
+	rejected := make([]bool, gm.Columns*gm.Rows)
+	parallelRows(workers, image.Rect(0, 0, gm.Columns, gm.Rows), func(row int) {
+		for column := 0; column < gm.Columns; column++ {
+			var dist float64
+			numberOfPixelsCompared := 0
+
+			b := gm.block(column, row)
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					currX, currY := m.Apply(float64(x), float64(y))
+					if currX < float64(bounds.Min.X) || currX > float64(bounds.Max.X-1) ||
+						currY < float64(bounds.Min.Y) || currY > float64(bounds.Max.Y-1) {
+						continue
+					}
+
+					l, a, b := reference.Lab(x, y)
+					dist += LabColor{L: l, A: a, B: b}.distance(interpolate(frame, currX, currY))
+					numberOfPixelsCompared++
+				}
+			}
+
+			rejected[row*gm.Columns+column] = numberOfPixelsCompared > 0 && dist/float64(numberOfPixelsCompared) > threshold
+		}
+	})
+
+	gm.Mask = dilate(rejected, gm.Columns, gm.Rows, dilation)
+
+	return gm
+}
+
+// dilate grows the set cells of the grid by radius cells in every direction, including the diagonals.
+func dilate(mask []bool, columns, rows, radius int) []bool {
+	res := make([]bool, len(mask))
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns; column++ {
+			if !mask[row*columns+column] {
+				continue
+			}
+
+			for y := row - radius; y <= row+radius; y++ {
+				for x := column - radius; x <= column+radius; x++ {
+					if x >= 0 && x < columns && y >= 0 && y < rows {
+						res[y*columns+x] = true
+					}
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+// Coverage returns the ratio of the rejected blocks.
+func (gm *GhostMask) Coverage() float64 {
+	rejected := 0
+	for _, r := range gm.Mask {
+		if r {
+			rejected++
+		}
+	}
+
+	return float64(rejected) / float64(len(gm.Mask))
+}
+
+// WriteToFile renders the mask at the size of the reference, the rejected pixels are white.
+func (gm *GhostMask) WriteToFile(filename string) error {
+	img := image.NewGray(gm.Bounds)
+	for y := gm.Bounds.Min.Y; y < gm.Bounds.Max.Y; y++ {
+		for x := gm.Bounds.Min.X; x < gm.Bounds.Max.X; x++ {
+			if gm.Rejected(x, y) {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return png.Encode(f, img)
+}
@@ -0,0 +1,125 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ghostBurst returns the reference, a clean copy and a frame with a dark square moving through the square.
+func ghostBurst(square image.Rectangle) []*Frame {
+	bounds := image.Rect(0, 0, 80, 60)
+	reference := texture(bounds, 0, 0)
+
+	ghost := texture(bounds, 0, 0)
+	draw.Draw(ghost, square, image.NewUniform(color.NRGBA{R: 20, G: 20, B: 30, A: 255}), image.Point{}, draw.Src)
+
+	return NewFrames([]image.Image{reference, texture(bounds, 0, 0), ghost}, 2)
+}
+
+func TestGhostMask(t *testing.T) {
+	square := image.Rect(40, 20, 52, 32)
+	frames := ghostBurst(square)
+
+	masks := estimateGhostMasks(context.Background(), frames, make([]Motion, len(frames)), bilinearInterpolation, 0.1, 4, 1, 2, nil)
+	if masks[0] != nil || masks[0].Rejected(45, 25) {
+		t.Error("The reference should never be masked")
+	}
+
+	if masks[1].Coverage() != 0 {
+		t.Errorf("The clean frame should not be masked, %f rejected", masks[1].Coverage())
+	}
+
+	for _, p := range []image.Point{{40, 20}, {51, 31}, {46, 26}, {36, 16}, {55, 35}} {
+		if !masks[2].Rejected(p.X, p.Y) {
+			t.Errorf("%v should be rejected as the square or its dilation", p)
+		}
+	}
+
+	for _, p := range []image.Point{{5, 5}, {35, 26}, {56, 26}, {46, 15}, {79, 59}} {
+		if masks[2].Rejected(p.X, p.Y) {
+			t.Errorf("%v should not be rejected", p)
+		}
+	}
+}
+
+func TestDilate(t *testing.T) {
+	mask := make([]bool, 5*4)
+	mask[1*5+1] = true
+
+	dilated := dilate(mask, 5, 4, 1)
+	for row := 0; row < 4; row++ {
+		for column := 0; column < 5; column++ {
+			expected := row <= 2 && column <= 2
+			if dilated[row*5+column] != expected {
+				t.Errorf("(%d, %d) should be %t", column, row, expected)
+			}
+		}
+	}
+}
+
+func TestDeghostMerge(t *testing.T) {
+	square := image.Rect(40, 20, 52, 32)
+	frames := ghostBurst(square)
+	motions := make([]Motion, len(frames))
+	masks := estimateGhostMasks(context.Background(), frames, motions, bilinearInterpolation, 0.1, 4, 1, 2, nil)
+
+	ghosted := superres(context.Background(), frames, motions, nil, averageColor, bilinearInterpolation, 2, nil)
+	deghosted := superres(context.Background(), frames, motions, masks, averageColor, bilinearInterpolation, 2, nil)
+
+	var ghostedDiff, deghostedDiff float64
+	for y := square.Min.Y; y < square.Max.Y; y++ {
+		for x := square.Min.X; x < square.Max.X; x++ {
+			expected := frames[0].Color(x, y)
+			ghostedDiff += rgbaToColorful(ghosted.At(x, y)).DistanceLab(expected)
+			deghostedDiff += rgbaToColorful(deghosted.At(x, y)).DistanceLab(expected)
+		}
+	}
+
+	pixels := float64(square.Dx() * square.Dy())
+	if deghostedDiff/pixels > 0.01 {
+		t.Errorf("The deghosted merge should match the reference under the moving object, mean difference %f", deghostedDiff/pixels)
+	}
+
+	if ghostedDiff/pixels < 0.1 {
+		t.Errorf("The plain merge should show the ghost, mean difference %f", ghostedDiff/pixels)
+	}
+}
+
+func TestGhostMaskWriteToFile(t *testing.T) {
+	frames := ghostBurst(image.Rect(40, 20, 52, 32))
+	mask := estimateGhostMask(frames[0], frames[2], Motion{}, bilinearInterpolation, 0.1, 4, 0, 2)
+
+	filename := filepath.Join(t.TempDir(), "mask.png")
+	if err := mask.WriteToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds() != frames[0].Rect {
+		t.Errorf("The mask should be the size of the reference, got %v", img.Bounds())
+	}
+
+	if g := color.GrayModel.Convert(img.At(45, 25)).(color.Gray); g.Y != 255 {
+		t.Errorf("Rejected pixels should be white, got %d", g.Y)
+	}
+
+	if g := color.GrayModel.Convert(img.At(5, 5)).(color.Gray); g.Y != 0 {
+		t.Errorf("Kept pixels should be black, got %d", g.Y)
+	}
+}
@@ -0,0 +1,389 @@
+package superres
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+const (
+	// Linear values of the brightest channel above which a pixel counts as clipped and below which as lost in the noise, when estimating the exposures.
+	hdrClipped = 0.9
+	hdrNoise   = 0.02
+
+	// The exposures are estimated on every nth pixel in both directions.
+	exposureSampleStep = 4
+
+	// Fewest quantiles two frames both have to expose well to estimate their exposure ratio.
+	minExposureSamples = 100
+
+	// Summed exposure weight of a pixel below which every frame counts as clipped or black.
+	minExposureWeight = 1e-3
+
+	// Key of the average luminance of the tone-mapped image.
+	toneMapKey = 0.18
+)
+
+// HDROutputs lists the valid formats of the HDR output.
+var HDROutputs = []string{"tonemap", "png16", "pfm"}
+
+// Radiance is the linear radiance map of an HDR merge, relative to the exposure of the reference.
+type Radiance struct {
+	img *floatImage
+}
+
+// Bounds returns the bounds of the radiance map.
+func (r *Radiance) Bounds() image.Rectangle {
+	return image.Rect(0, 0, r.img.width, r.img.height)
+}
+
+// mergeHDR merges a burst of differently exposed frames into a radiance map, relative to the exposure of the reference.
+// The frames are aligned at a common exposure, so the color distances of the motion estimation compare the same intensities,
+// then merged in linear light weighting every pixel by how well it is exposed.
+// It returns the radiance map and its tone-mapped image at the working resolution.
+func (o *Options) mergeHDR(ctx context.Context, images []string, upscaleResampleFilter imaging.ResampleFilter) (*Result, error) {
+	loadedImages, err := loadImages(ctx, images, o.startStage(StageLoad, len(images), 0))
+	if err != nil {
+		return nil, err
+	}
+
+	exposures, err := o.frameExposures(images, loadedImages)
+	if err != nil {
+		return nil, err
+	}
+
+	// The frames are aligned at the exposure of the middle frame, so the fewest pixels clip.
+	target := median(append([]float64(nil), exposures...))
+	normalized := make([]image.Image, len(loadedImages))
+	for i := range loadedImages {
+		o.verbosef("Exposure: %s\t %f\n", images[i], exposures[i]/target)
+		normalized[i] = normalizeExposure(loadedImages[i], target/exposures[i], o.workers())
+	}
+
+	referenceIndex, err := o.selectReference(images, normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	o.moveReferenceFirst(images, referenceIndex, loadedImages, normalized, exposures)
+
+	res := &Result{Stats: Stats{InputBounds: loadedImages[0].Bounds(), Exposures: make([]float64, len(exposures))}}
+	for i := range exposures {
+		res.Stats.Exposures[inputIndex(referenceIndex, i)] = exposures[i] / exposures[0]
+	}
+
+	if o.Scale != 1 {
+		loadedImages = upscale(loadedImages, o.Scale, upscaleResampleFilter)
+		normalized = upscale(normalized, o.Scale, upscaleResampleFilter)
+	}
+
+	motionCorrection, cached, err := o.getMotionCorrection(ctx, images, NewFrames(normalized, o.workers()), referenceIndex, o.Scale)
+	if err != nil {
+		return nil, err
+	}
+	res.Stats.CachedMotions = cached
+
+	kept := make([]int, len(motionCorrection))
+	for i := range kept {
+		kept[i] = i
+	}
+	res.setRegistration(referenceIndex, motionCorrection, kept)
+
+	// Every frame of a bracket holds a part of the range, and the clipped ones differ from the others even normalized, so none is pulled as an outlier.
+	linear := make([]*floatImage, len(loadedImages))
+	for i := range loadedImages {
+		linear[i] = linearFloatImage(loadedImages[i])
+	}
+
+	progress := o.startStage(StageMerge, 0, int64(linear[0].width)*int64(linear[0].height))
+	radiance := mergeRadiance(ctx, linear, scaleMotions(motionCorrection, o.Scale), exposures, o.workers(), progress)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res.Radiance = &Radiance{img: radiance}
+	res.Image = toneMap(radiance)
+
+	return res, nil
+}
+
+// frameExposures returns the relative exposure of every frame, from the EXIF data if every frame has it, or estimated from the pixels otherwise.
+func (o *Options) frameExposures(imageNames []string, images []image.Image) ([]float64, error) {
+	exposures := make([]float64, len(images))
+	for i := range imageNames {
+		e, err := readExposure(imageNames[i])
+		if err != nil {
+			o.verbosef("No exposure in %s (%s), estimating the exposures from the pixels\n", imageNames[i], err)
+			return estimateExposures(images)
+		}
+
+		exposures[i] = e.Relative()
+	}
+
+	return exposures, nil
+}
+
+// estimateExposures estimates the exposures relative to the darkest frame.
+// The frames are ordered by brightness and every frame is compared to the next darker one, so the frames at the two ends of a wide bracket don't need to overlap.
+// A pair is compared with the median ratio of the quantiles of their brightest linear channel that both exposed well.
+// Unlike the luminance, the brightest channel clips at the same quantile in every channel, so the clipping only cuts off the top quantiles.
+// Comparing the distributions rather than the pixels makes it independent of the motion between the frames, which is only estimated once they are normalized.
+func estimateExposures(images []image.Image) ([]float64, error) {
+	channels := make([][]float64, len(images))
+	brightness := make([]float64, len(images))
+	for i := range images {
+		channels[i] = sampledChannels(images[i])
+		for _, v := range channels[i] {
+			brightness[i] += v
+		}
+
+		if len(channels[i]) != len(channels[0]) {
+			return nil, fmt.Errorf("frame %d is not the same size as the first frame", i)
+		}
+		sort.Float64s(channels[i])
+	}
+
+	order := make([]int, len(images))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return brightness[order[i]] < brightness[order[j]] })
+
+	exposures := make([]float64, len(images))
+	exposures[order[0]] = 1
+	for k := 1; k < len(order); k++ {
+		darker, brighter := channels[order[k-1]], channels[order[k]]
+
+		var ratios []float64
+		for i := range darker {
+			if darker[i] > hdrNoise && darker[i] < hdrClipped && brighter[i] > hdrNoise && brighter[i] < hdrClipped {
+				ratios = append(ratios, brighter[i]/darker[i])
+			}
+		}
+
+		if len(ratios) < minExposureSamples {
+			return nil, fmt.Errorf("frames %d and %d only have %d well exposed quantiles in common, too few to estimate their exposure", order[k-1], order[k], len(ratios))
+		}
+
+		exposures[order[k]] = exposures[order[k-1]] * median(ratios)
+	}
+
+	return exposures, nil
+}
+
+// sampledChannels returns the brightest linear channel of every exposureSampleStep pixel.
+func sampledChannels(img image.Image) []float64 {
+	bounds := img.Bounds()
+
+	var res []float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += exposureSampleStep {
+		for x := bounds.Min.X; x < bounds.Max.X; x += exposureSampleStep {
+			r, g, b := rgbaToColorful(img.At(x, y)).LinearRgb()
+			res = append(res, math.Max(r, math.Max(g, b)))
+		}
+	}
+
+	return res
+}
+
+// normalizeExposure multiplies the image by the gain in linear light on workers goroutines, clipping it like a camera would.
+func normalizeExposure(img image.Image, gain float64, workers int) *image.NRGBA {
+	return PhotometricCorrection{Gain: [3]float64{gain, gain, gain}}.Apply(img, workers)
+}
+
+// linearFloatImage returns the channels of the image in linear light, undoing the sRGB curve.
+func linearFloatImage(img image.Image) *floatImage {
+	f := floatImageFrom(img)
+	for i := range f.pix {
+		f.pix[i], _, _ = colorful.Color{R: f.pix[i]}.LinearRgb()
+	}
+
+	return f
+}
+
+// exposureWeight favours the pixels in the middle of the range of the camera, going to 0 as the brightest channel clips or the pixel sinks in the noise.
+func exposureWeight(c [3]float64) float64 {
+	v := colorful.LinearRgb(math.Max(c[0], math.Max(c[1], c[2])), 0, 0).R
+
+	return 1 - math.Pow(2*v-1, 12)
+}
+
+// mergeRadiance merges the linear frames into a radiance map relative to the exposure of the first frame, weighting every sample by exposureWeight.
+// Where every frame is clipped or black, it takes the shortest exposure for the bright pixels and the longest one for the dark pixels.
+// The motions are in working pixels. It reports the pixels of every merged row, and stops early when the context is canceled, leaving the map incomplete.
+func mergeRadiance(ctx context.Context, frames []*floatImage, motionCorrection []Motion, exposures []float64, workers int, progress *progressTracker) *floatImage {
+	width, height := frames[0].width, frames[0].height
+	res := newFloatImage(width, height)
+
+	parallelRows(workers, image.Rect(0, 0, width, height), func(y int) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		for x := 0; x < width; x++ {
+			var sum [3]float64
+			var weights float64
+			shortest, longest := -1, -1
+			var shortestColor, longestColor [3]float64
+
+			for i := range frames {
+				currX, currY := motionCorrection[i].Apply(float64(x), float64(y))
+				if currX < 0 || currX > float64(width-1) || currY < 0 || currY > float64(height-1) {
+					continue
+				}
+
+				c := frames[i].bilinear(currX, currY)
+				w := exposureWeight(c)
+				for ch := range c {
+					sum[ch] += w * c[ch] / exposures[i]
+				}
+				weights += w
+
+				if shortest == -1 || exposures[i] < exposures[shortest] {
+					shortest, shortestColor = i, c
+				}
+				if longest == -1 || exposures[i] > exposures[longest] {
+					longest, longestColor = i, c
+				}
+			}
+
+			if weights < minExposureWeight {
+				weights = 1
+				sum = [3]float64{}
+				fallback, exposure := longestColor, exposures[longest]
+				if math.Max(shortestColor[0], math.Max(shortestColor[1], shortestColor[2])) > 0.5 {
+					fallback, exposure = shortestColor, exposures[shortest]
+				}
+				for ch := range fallback {
+					sum[ch] = fallback[ch] / exposure
+				}
+			}
+
+			i := (y*width + x) * 3
+			for ch := range sum {
+				res.pix[i+ch] = sum[ch] / weights * exposures[0]
+			}
+		}
+		progress.addPixels(int64(width))
+	})
+
+	return res
+}
+
+// resize resamples the image to the size, interpolating bilinearly between the pixel centers.
+func (f *floatImage) resize(width, height int) *floatImage {
+	if width == f.width && height == f.height {
+		return f
+	}
+
+	res := newFloatImage(width, height)
+	for y := 0; y < height; y++ {
+		sy := math.Max(0, math.Min(float64(f.height-1), (float64(y)+0.5)*float64(f.height)/float64(height)-0.5))
+		for x := 0; x < width; x++ {
+			sx := math.Max(0, math.Min(float64(f.width-1), (float64(x)+0.5)*float64(f.width)/float64(width)-0.5))
+			c := f.bilinear(sx, sy)
+			copy(res.pix[(y*width+x)*3:], c[:])
+		}
+	}
+
+	return res
+}
+
+// toneMap compresses the radiance map to an 8-bit image with Reinhard's global operator, scaling the log-average luminance to toneMapKey and the brightest pixel to white.
+func toneMap(radiance *floatImage) *image.NRGBA {
+	luminance := make([]float64, radiance.width*radiance.height)
+	var logSum float64
+	for i := range luminance {
+		luminance[i] = 0.2126*radiance.pix[i*3] + 0.7152*radiance.pix[i*3+1] + 0.0722*radiance.pix[i*3+2]
+		logSum += math.Log(1e-6 + luminance[i])
+	}
+
+	scaling := toneMapKey / math.Exp(logSum/float64(len(luminance)))
+	var white float64
+	for _, l := range luminance {
+		white = math.Max(white, l*scaling)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, radiance.width, radiance.height))
+	for i, l := range luminance {
+		if l <= 0 {
+			continue
+		}
+
+		scaled := l * scaling
+		ratio := scaled * (1 + scaled/(white*white)) / (1 + scaled) / l
+		c := colorful.LinearRgb(math.Min(1, radiance.pix[i*3]*ratio), math.Min(1, radiance.pix[i*3+1]*ratio), math.Min(1, radiance.pix[i*3+2]*ratio))
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2] = floatChannel(c.R), floatChannel(c.G), floatChannel(c.B)
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+
+	return img
+}
+
+// Encode writes the radiance map in one of the HDROutputs other than the tone-mapped one.
+// png16 is a 16-bit sRGB PNG with the brightest channel scaled to white, pfm is the linear radiance as floats.
+func (r *Radiance) Encode(w io.Writer, format string) error {
+	switch format {
+	case "png16":
+		return png.Encode(w, r.img.NRGBA64())
+	case "pfm":
+		return r.img.writePFM(w)
+	default:
+		return fmt.Errorf("invalid HDR output %s, valid outputs are %v", format, HDROutputs)
+	}
+}
+
+// NRGBA64 encodes the image in 16-bit sRGB, scaled so the brightest channel is white.
+func (f *floatImage) NRGBA64() *image.NRGBA64 {
+	var max float64
+	for _, v := range f.pix {
+		max = math.Max(max, v)
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	channel := func(v float64) uint16 {
+		return uint16(math.Round(colorful.LinearRgb(math.Max(0, v/max), 0, 0).R * 65535))
+	}
+
+	img := image.NewNRGBA64(image.Rect(0, 0, f.width, f.height))
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			i := (y*f.width + x) * 3
+			img.SetNRGBA64(x, y, color.NRGBA64{R: channel(f.pix[i]), G: channel(f.pix[i+1]), B: channel(f.pix[i+2]), A: 65535})
+		}
+	}
+
+	return img
+}
+
+// writePFM writes the image as a little-endian Portable Float Map, which stores the rows from the bottom up.
+func (f *floatImage) writePFM(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "PF\n%d %d\n-1.0\n", f.width, f.height)
+
+	row := make([]byte, f.width*3*4)
+	for y := f.height - 1; y >= 0; y-- {
+		for i, v := range f.pix[y*f.width*3 : (y+1)*f.width*3] {
+			binary.LittleEndian.PutUint32(row[i*4:], math.Float32bits(float32(v)))
+		}
+
+		if _, err := buf.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return buf.Flush()
+}
@@ -0,0 +1,212 @@
+package superres
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+// hdrScene returns the linear radiance of a scene spanning about 6 stops from left to right.
+func hdrScene(x, y int) [3]float64 {
+	ramp := 0.02 * math.Exp(4*float64(x)/96)
+	texture := 1 + 0.3*math.Sin(float64(y)/5)
+
+	return [3]float64{ramp * texture, ramp, ramp * 0.8}
+}
+
+// bracket captures the scene with the exposure, clipping and quantizing it like an 8-bit camera.
+func bracket(exposure float64) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			r := hdrScene(x, y)
+			c := colorful.LinearRgb(math.Min(1, r[0]*exposure), math.Min(1, r[1]*exposure), math.Min(1, r[2]*exposure))
+			img.SetNRGBA(x, y, color.NRGBA{R: floatChannel(c.R), G: floatChannel(c.G), B: floatChannel(c.B), A: 255})
+		}
+	}
+
+	return img
+}
+
+func TestEstimateExposures(t *testing.T) {
+	exposures, err := estimateExposures([]image.Image{bracket(1), bracket(0.25), bracket(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []float64{4, 1, 16} {
+		if math.Abs(exposures[i]/expected-1) > 0.05 {
+			t.Errorf("Frame %d should be exposed %f times the darkest one, got %f", i, expected, exposures[i])
+		}
+	}
+}
+
+func TestEstimateExposuresAcrossMotion(t *testing.T) {
+	bounds := image.Rect(0, 0, 160, 120)
+	reference := texture(bounds, 0, 0)
+	moved := texture(bounds, 5, 3)
+
+	// Two stops darker and moved.
+	dark := normalizeExposure(moved, 0.25, 2)
+	exposures, err := estimateExposures([]image.Image{reference, dark})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ratio := exposures[0] / exposures[1]
+	if math.Abs(ratio/4-1) > 0.1 {
+		t.Errorf("The frames should be 2 stops apart, got a ratio of %f", ratio)
+	}
+
+	// The distances of the motion estimation only compare the frames at the same exposure.
+	opts := DefaultOptions()
+	expected := opts.estimateMotion(reference, moved)
+	if m := opts.estimateMotion(reference, normalizeExposure(dark, ratio, 2)); m.X != expected.X || m.Y != expected.Y || m.X == 0 {
+		t.Errorf("The normalized frame should move %s like the frame at the same exposure, got %s", expected, m)
+	}
+}
+
+func TestMergeRadiance(t *testing.T) {
+	exposures := []float64{1, 0.25, 4}
+	frames := make([]*floatImage, len(exposures))
+	for i, e := range exposures {
+		frames[i] = linearFloatImage(bracket(e))
+	}
+
+	radiance := mergeRadiance(context.Background(), frames, make([]Motion, len(frames)), exposures, 2, nil)
+
+	for y := 0; y < 64; y += 7 {
+		for x := 0; x < 96; x += 5 {
+			expected := hdrScene(x, y)
+			got := radiance.pix[(y*96+x)*3 : (y*96+x)*3+3]
+			for ch := range expected {
+				if math.Abs(got[ch]/expected[ch]-1) > 0.05 {
+					t.Fatalf("Radiance at (%d, %d) should be %v, got %v", x, y, expected, got)
+				}
+			}
+		}
+	}
+
+	// The right side is clipped in the reference, the merge recovers it from the short exposure.
+	if r := radiance.pix[(10*96+95)*3+1]; r < 1.02 {
+		t.Errorf("Highlights should be recovered above the clipping of the reference, got %f", r)
+	}
+}
+
+func TestMergeRadianceClipped(t *testing.T) {
+	white := newFloatImage(4, 4)
+	for i := range white.pix {
+		white.pix[i] = 1
+	}
+
+	radiance := mergeRadiance(context.Background(), []*floatImage{white, white}, make([]Motion, 2), []float64{1, 0.5}, 2, nil)
+	if radiance.pix[0] != 2 {
+		t.Errorf("Clipped pixels should take the shortest exposure, got %f", radiance.pix[0])
+	}
+
+	black := newFloatImage(4, 4)
+	radiance = mergeRadiance(context.Background(), []*floatImage{black, black}, make([]Motion, 2), []float64{1, 0.5}, 2, nil)
+	if radiance.pix[0] != 0 {
+		t.Errorf("Black pixels should stay black, got %f", radiance.pix[0])
+	}
+}
+
+func TestToneMap(t *testing.T) {
+	exposures := []float64{1, 0.25, 4}
+	frames := make([]*floatImage, len(exposures))
+	for i, e := range exposures {
+		frames[i] = linearFloatImage(bracket(e))
+	}
+
+	img := toneMap(mergeRadiance(context.Background(), frames, make([]Motion, len(frames)), exposures, 2, nil))
+
+	// The ramp should stay increasing from left to right, without clipping on either side.
+	previous := -1.0
+	for x := 0; x < 96; x++ {
+		l, _, _ := rgbaToColorful(img.At(x, 0)).Lab()
+		if l < previous {
+			t.Fatalf("Tone mapping should keep the order of the luminance, %f < %f at %d", l, previous, x)
+		}
+		previous = l
+	}
+
+	if c := img.NRGBAAt(0, 0); c.G == 0 {
+		t.Errorf("The shadows should not be crushed to black")
+	}
+
+	if c := img.NRGBAAt(94, 0); c.G == 255 {
+		t.Errorf("The highlights should not be clipped")
+	}
+}
+
+func TestWritePFM(t *testing.T) {
+	f := newFloatImage(2, 2)
+	for i := range f.pix {
+		f.pix[i] = float64(i)
+	}
+
+	var buf bytes.Buffer
+	if err := f.writePFM(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	header := "PF\n2 2\n-1.0\n"
+	if !bytes.HasPrefix(buf.Bytes(), []byte(header)) || buf.Len() != len(header)+2*2*3*4 {
+		t.Fatalf("Unexpected PFM layout %q", buf.Bytes())
+	}
+
+	// The rows are stored from the bottom up.
+	first := math.Float32frombits(binary.LittleEndian.Uint32(buf.Bytes()[len(header):]))
+	if first != 6 {
+		t.Errorf("The first pixel written should be the bottom left one, got %f", first)
+	}
+}
+
+func TestProcessHDR(t *testing.T) {
+	dir := t.TempDir()
+	var frames []string
+	for i, e := range []float64{1, 0.25, 4} {
+		name := filepath.Join(dir, strconv.Itoa(i)+".png")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, bracket(e)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		frames = append(frames, name)
+	}
+
+	opts := testOptions()
+	opts.HDR, opts.Scale = true, 1
+	res, err := Process(context.Background(), frames, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Radiance == nil || res.Radiance.Bounds() != res.Image.Bounds() {
+		t.Fatalf("An HDR merge should return the radiance at the output size")
+	}
+
+	for i, expected := range []float64{1, 0.25, 4} {
+		if math.Abs(res.Stats.Exposures[i]/expected-1) > 0.05 {
+			t.Errorf("Frame %d should be exposed %f times the reference, got %f", i, expected, res.Stats.Exposures[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := res.Radiance.Encode(&buf, "pfm"); err != nil || !bytes.HasPrefix(buf.Bytes(), []byte("PF\n96 64\n")) {
+		t.Errorf("Expected a 96x64 PFM, got %v", err)
+	}
+}
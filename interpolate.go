@@ -0,0 +1,85 @@
+package superres
+
+import (
+	"math"
+)
+
+// Interpolator returns the color of the frame at a fractional position.
+// The channels are interpolated in Lab, the color space the frames are stored and merged in.
+type Interpolator func(f *Frame, x, y float64) LabColor
+
+// Interpolations lists the valid names of GetInterpolator.
+var Interpolations = []string{"nearest", "bilinear", "bicubic"}
+
+// GetInterpolator returns the interpolation implementation by name.
+func GetInterpolator(name string) Interpolator {
+	switch name {
+	case "nearest":
+		return nearestInterpolation
+	case "bicubic":
+		return bicubicInterpolation
+	default:
+		return bilinearInterpolation
+	}
+}
+
+func nearestInterpolation(f *Frame, x, y float64) LabColor {
+	l, a, b := f.clampedLab(int(math.Round(x)), int(math.Round(y)))
+
+	return LabColor{L: l, A: a, B: b}
+}
+
+func bilinearInterpolation(f *Frame, x, y float64) LabColor {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	l00, a00, b00 := f.clampedLab(ix, iy)
+	l10, a10, b10 := f.clampedLab(ix+1, iy)
+	l01, a01, b01 := f.clampedLab(ix, iy+1)
+	l11, a11, b11 := f.clampedLab(ix+1, iy+1)
+
+	return LabColor{
+		L: lerp(lerp(l00, l10, fx), lerp(l01, l11, fx), fy),
+		A: lerp(lerp(a00, a10, fx), lerp(a01, a11, fx), fy),
+		B: lerp(lerp(b00, b10, fx), lerp(b01, b11, fx), fy),
+	}
+}
+
+// bicubicInterpolation uses the Catmull-Rom spline over the 4x4 neighbourhood.
+func bicubicInterpolation(f *Frame, x, y float64) LabColor {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	var res LabColor
+	for j := -1; j <= 2; j++ {
+		wy := catmullRom(float64(j) - fy)
+		for i := -1; i <= 2; i++ {
+			w := catmullRom(float64(i)-fx) * wy
+			cl, ca, cb := f.clampedLab(ix+i, iy+j)
+			res.L += cl * w
+			res.A += ca * w
+			res.B += cb * w
+		}
+	}
+
+	return res
+}
+
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return 1.5*x*x*x - 2.5*x*x + 1
+	}
+
+	if x < 2 {
+		return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+	}
+
+	return 0
+}
+
+func lerp(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
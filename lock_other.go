@@ -0,0 +1,9 @@
+//go:build !unix
+
+package superres
+
+// lockFile doesn't lock anything where flock is not available.
+// The cache file is still replaced atomically, concurrent runs can only lose each other's new entries.
+func lockFile(filename string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package superres
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile locks the file, shared or exclusively, blocking until the lock is free.
+// The returned function releases the lock.
+func lockFile(filename string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,67 @@
+package superres
+
+import (
+	"context"
+	"image"
+)
+
+// Size in pixels of the square tiles the merge is split into between the workers.
+const mergeTileSize = 64
+
+// superres merges the motion corrected images into one, on workers goroutines.
+// Every pixel only depends on the images, so the output is the same regardless of how the tiles are scheduled.
+// The pixels rejected by the ghost masks of their frame are left out of the merge, masks can be nil to merge every pixel.
+// It reports the pixels of every merged tile, and stops early when the context is canceled, leaving the output incomplete.
+func superres(ctx context.Context, images []*Frame, motionCorrection []Motion, masks []*GhostMask, colorMergeMethod ColorMerge, interpolate Interpolator, workers int, progress *progressTracker) *image.NRGBA {
+	bounds := images[0].Bounds()
+	output := image.NewNRGBA(bounds)
+
+	tiles := mergeTiles(bounds, mergeTileSize)
+	parallelWorkers(workers, len(tiles), func() func(i int) {
+		// The colors of a pixel, reused between the pixels of the worker.
+		currentColor := make([]LabColor, 0, len(images))
+
+		return func(t int) {
+			tile := tiles[t]
+			if ctx.Err() != nil {
+				return
+			}
+
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				for x := tile.Min.X; x < tile.Max.X; x++ {
+					currentColor = currentColor[:0]
+
+					for i := range images {
+						currX, currY := motionCorrection[i].Apply(float64(x), float64(y))
+						if currX < float64(bounds.Min.X) || currX > float64(bounds.Max.X-1) ||
+							currY < float64(bounds.Min.Y) || currY > float64(bounds.Max.Y-1) {
+							continue
+						}
+
+						if masks != nil && masks[i].Rejected(x, y) {
+							continue
+						}
+
+						currentColor = append(currentColor, interpolate(images[i], currX, currY))
+					}
+					output.Set(x, y, colorMergeMethod(currentColor).Color())
+				}
+			}
+			progress.addPixels(int64(tile.Dx() * tile.Dy()))
+		}
+	})
+
+	return output
+}
+
+// mergeTiles splits the bounds into tiles of the given size, the tiles on the right and bottom edges may be smaller.
+func mergeTiles(bounds image.Rectangle, tileSize int) []image.Rectangle {
+	var tiles []image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += tileSize {
+			tiles = append(tiles, image.Rect(x, y, x+tileSize, y+tileSize).Intersect(bounds))
+		}
+	}
+
+	return tiles
+}
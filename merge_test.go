@@ -0,0 +1,121 @@
+package superres
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// mergeFrames returns a textured frame with the given number of copies, and motions mixing whole, sub-pixel and transform motion.
+func mergeFrames(width, height, frames int) ([]*Frame, []Motion) {
+	bounds := image.Rect(0, 0, width, height)
+	reference := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			reference.Set(x, y, color.NRGBA{
+				R: uint8(127 + 127*math.Sin(float64(x)/7)),
+				G: uint8(127 + 127*math.Cos(float64(y)/5)),
+				B: uint8(127 + 127*math.Sin(float64(x+y)/11)),
+				A: 255,
+			})
+		}
+	}
+
+	frame := NewFrame(reference)
+	images := make([]*Frame, frames)
+	motions := make([]Motion, frames)
+	for i := range images {
+		images[i] = frame
+		motions[i] = Motion{X: i % 3, Y: -i % 2, SubX: 0.25 * float64(i%4), SubY: 0.1 * float64(i%5)}
+		if i%4 == 3 {
+			rotation := normalizedTransform("euclidean", []float64{0, 0, 0.002 * float64(i)}, bounds)
+			motions[i].Transform = &rotation
+		}
+	}
+
+	return images, motions
+}
+
+// serialSuperres is the merge on a single goroutine, pixel by pixel, to check the parallel merge against.
+func serialSuperres(images []*Frame, motionCorrection []Motion, colorMergeMethod ColorMerge, interpolate Interpolator) *image.NRGBA {
+	bounds := images[0].Bounds()
+	output := image.NewNRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			currentColor := []LabColor{}
+			for i := range images {
+				currX, currY := motionCorrection[i].Apply(float64(x), float64(y))
+				if currX < float64(bounds.Min.X) || currX > float64(bounds.Max.X-1) ||
+					currY < float64(bounds.Min.Y) || currY > float64(bounds.Max.Y-1) {
+					continue
+				}
+
+				currentColor = append(currentColor, interpolate(images[i], currX, currY))
+			}
+			output.Set(x, y, colorMergeMethod(currentColor).Color())
+		}
+	}
+
+	return output
+}
+
+func TestSuperresParallelIdentical(t *testing.T) {
+	// Not a multiple of the tile size, so the edge tiles are partial.
+	images, motions := mergeFrames(150, 70, 6)
+
+	for _, name := range MergeMethods {
+		merge, _ := GetColorMerge(name, 2.5, 3, 20)
+		expected := serialSuperres(images, motions, merge, bicubicInterpolation)
+
+		for _, p := range []int{1, 3, 8} {
+			output := superres(context.Background(), images, motions, nil, merge, bicubicInterpolation, p, nil)
+			if !bytes.Equal(output.Pix, expected.Pix) {
+				t.Errorf("%s: merge on %d workers should be identical to the serial merge", name, p)
+			}
+		}
+	}
+}
+
+func TestMergeTiles(t *testing.T) {
+	bounds := image.Rect(10, 20, 150, 90)
+	tiles := mergeTiles(bounds, 64)
+	if len(tiles) != 6 {
+		t.Fatalf("140x70 should be split into 6 tiles of 64, got %d", len(tiles))
+	}
+
+	area := 0
+	for _, tile := range tiles {
+		if !tile.In(bounds) {
+			t.Errorf("Tile %v should be inside %v", tile, bounds)
+		}
+		area += tile.Dx() * tile.Dy()
+	}
+
+	if area != bounds.Dx()*bounds.Dy() {
+		t.Errorf("Tiles should cover the bounds exactly once, covered %d pixels of %d", area, bounds.Dx()*bounds.Dy())
+	}
+}
+
+func BenchmarkSuperres(b *testing.B) {
+	images, motions := mergeFrames(320, 240, 16)
+	merge, _ := GetColorMerge("median", 0, 0, 0)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			serialSuperres(images, motions, merge, bilinearInterpolation)
+		}
+	})
+
+	for _, p := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", p), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				superres(context.Background(), images, motions, nil, merge, bilinearInterpolation, p, nil)
+			}
+		})
+	}
+}
@@ -1,21 +1,127 @@
-package main
+package superres
 
 import (
-	"bytes"
-	"encoding/json"
+	"fmt"
 	"image"
-	"io/ioutil"
 	"math"
-	"os"
+	"math/rand"
 
 	"github.com/Coornail/superres/sampler"
-	colorful "github.com/lucasb-eyer/go-colorful"
 )
 
 type Motion struct {
 	X    int
 	Y    int
 	Diff float64
+
+	// SubX and SubY are the sub-pixel refinement of X and Y, in the range of [-0.5, 0.5].
+	SubX float64
+	SubY float64
+
+	// Transform is set when the motion was refined beyond a translation (@see estimateTransform).
+	Transform *Transform `json:",omitempty"`
+
+	// Tiles is set when the motion was estimated per tile (@see estimateTiles).
+	Tiles *DisplacementField `json:",omitempty"`
+}
+
+// Offset returns the motion including the sub-pixel refinement.
+func (m Motion) Offset() (x, y float64) {
+	return float64(m.X) + m.SubX, float64(m.Y) + m.SubY
+}
+
+// Apply returns the position of the reference image point (x, y) in the candidate image.
+// The local motion of the tiles refines the global motion.
+func (m Motion) Apply(x, y float64) (float64, float64) {
+	cx, cy := m.applyGlobal(x, y)
+	if m.Tiles != nil {
+		residualX, residualY := m.Tiles.Offset(x, y)
+		cx, cy = cx+residualX, cy+residualY
+	}
+
+	return cx, cy
+}
+
+// Inverse returns the position of the reference image point that moves to (x, y) of the candidate image.
+func (m Motion) Inverse(x, y float64) (float64, float64) {
+	rx, ry := m.inverseGlobal(x, y)
+	if m.Tiles != nil {
+		// The displacement field changes slowly, so a few fixed-point iterations are enough.
+		for i := 0; i < 3; i++ {
+			residualX, residualY := m.Tiles.Offset(rx, ry)
+			rx, ry = m.inverseGlobal(x-residualX, y-residualY)
+		}
+	}
+
+	return rx, ry
+}
+
+// applyGlobal applies the motion of the whole frame, without the tiles.
+func (m Motion) applyGlobal(x, y float64) (float64, float64) {
+	if m.Transform != nil {
+		return m.Transform.Apply(x, y)
+	}
+
+	motionX, motionY := m.Offset()
+	return x + motionX, y + motionY
+}
+
+// inverseGlobal inverts the motion of the whole frame, without the tiles.
+func (m Motion) inverseGlobal(x, y float64) (float64, float64) {
+	if m.Transform != nil {
+		return m.Transform.Inverse().Apply(x, y)
+	}
+
+	motionX, motionY := m.Offset()
+	return x - motionX, y - motionY
+}
+
+// Scale converts the motion to an image scaled by factor, keeping the pixel centers aligned.
+func (m Motion) Scale(factor float64) Motion {
+	x, y := m.Offset()
+	scaled := Motion{
+		X:    int(math.Round(x * factor)),
+		Y:    int(math.Round(y * factor)),
+		Diff: m.Diff,
+	}
+	scaled.SubX, scaled.SubY = x*factor-float64(scaled.X), y*factor-float64(scaled.Y)
+
+	if m.Transform != nil {
+		// A pixel center moves from l to l*factor + (factor-1)/2 in the scaled image.
+		shift := (factor - 1) / 2
+		toScaled := [9]float64{factor, 0, shift, 0, factor, shift, 0, 0, 1}
+		fromScaled := [9]float64{1 / factor, 0, -shift / factor, 0, 1 / factor, -shift / factor, 0, 0, 1}
+		scaled.Transform = &Transform{
+			Model:  m.Transform.Model,
+			Matrix: multiplyMatrix(toScaled, multiplyMatrix(m.Transform.Matrix, fromScaled)),
+		}
+	}
+
+	if m.Tiles != nil {
+		tiles := *m.Tiles
+		tiles.Scale = m.Tiles.scale() * factor
+		scaled.Tiles = &tiles
+	}
+
+	return scaled
+}
+
+// Model returns the name of the transform model the motion was estimated with.
+func (m Motion) Model() string {
+	if m.Transform != nil {
+		return m.Transform.Model
+	}
+
+	return "translation"
+}
+
+func (m Motion) String() string {
+	if m.Transform != nil {
+		return m.Transform.String()
+	}
+
+	motionX, motionY := m.Offset()
+	return fmt.Sprintf("x:%.2f y:%.2f", motionX, motionY)
 }
 
 const (
@@ -28,6 +134,15 @@ const (
 	// Direction change in the spiral since we saw improvement in the picture differences.
 	// We change direction 4 times to go "full circle".
 	MaxDirectionChangeSinceImprovement = 32
+
+	// DefaultPyramidLevels is the number of image pyramid levels used for the coarse-to-fine motion search.
+	DefaultPyramidLevels = 3
+
+	// Motion search radius in pixels on every pyramid level but the coarsest.
+	pyramidRefineRadius = 2
+
+	// We don't build pyramid levels smaller than this, as there is not enough detail left to compare.
+	minPyramidSize = 32
 )
 
 // getOutliers returns the indexes for every motion that is over one standard deviation from the mean.
@@ -62,59 +177,98 @@ func getOutliers(motions []Motion) []int {
 	return outliers
 }
 
-// estimateMotion tries to move the candidate image to best match the reference image.
-// Comparing the reference image works by taking a sample (@see GetSampler) from both images and calculate the sum of square color differences.
-func estimateMotion(reference, candidate image.Image) Motion {
-	bounds := reference.Bounds()
-	ref := NewImageCache(reference)
+// estimateMotion tries to move the candidate image to best match the reference image with the configured estimator (@see GetEstimator).
+func (o *Options) estimateMotion(reference, candidate image.Image) Motion {
+	estimator, err := GetEstimator(o.Estimator)
+	if err != nil {
+		panic(err)
+	}
 
-	var bestXMotion, bestYMotion int
-	var bestDist = math.MaxFloat64
+	return estimator.Estimate(reference, candidate, o.estimatorOptions())
+}
 
-	maxXMotion := math.Round(float64(bounds.Max.X) * maxMotion)
-	maxYMotion := math.Round(float64(bounds.Max.Y) * maxMotion)
+// estimatePyramidMotion searches the motion coarse-to-fine.
+// Comparing the reference image works by taking a sample (@see NewSampler) from both images and calculate the sum of square color differences.
+// The whole search range is only covered on the smallest level of the image pyramid, every finer level refines the motion found on the previous one.
+func estimatePyramidMotion(reference, candidate image.Image, options EstimatorOptions) Motion {
+	references := buildPyramid(asFrame(reference), options.PyramidLevels)
+	candidates := buildPyramid(asFrame(candidate), options.PyramidLevels)
+
+	var m Motion
+	for level := len(references) - 1; level >= 0; level-- {
+		ref := references[level]
+		smp := NewSampler(options.Sampler, ref, ImageSamples, options.Seed)
+
+		radius := pyramidRefineRadius
+		if level == len(references)-1 {
+			bounds := references[level].Bounds()
+			maxXMotion := math.Round(float64(bounds.Dx()) * options.SearchRange)
+			maxYMotion := math.Round(float64(bounds.Dy()) * options.SearchRange)
+			radius = int(math.Max(maxXMotion, maxYMotion)) / 2
+		} else {
+			m.X, m.Y = m.X*2, m.Y*2
+		}
+
+		m = spiralSearch(ref, candidates[level], smp, m.X, m.Y, radius)
+
+		if level == 0 {
+			m = refineMotion(ref, candidates[level], smp, m)
+		}
+	}
 
-	max := int(math.Max(maxXMotion, maxYMotion))
-	m2 := max * max
+	return m
+}
+
+// buildPyramid returns the frame downscaled by half on every level, starting with the original frame.
+// It stops early if the frame would get too small to compare.
+func buildPyramid(f *Frame, levels int) []*Frame {
+	pyramid := []*Frame{f}
+	for i := 1; i < levels; i++ {
+		bounds := pyramid[i-1].Bounds()
+		if bounds.Dx()/2 < minPyramidSize || bounds.Dy()/2 < minPyramidSize {
+			break
+		}
+
+		pyramid = append(pyramid, pyramid[i-1].half())
+	}
+
+	return pyramid
+}
+
+// spiralSearch walks in a spiral around (centerX, centerY) up to radius pixels and returns the motion with the smallest distance.
+func spiralSearch(ref, candidate *Frame, smp sampler.ImageSampler, centerX, centerY, radius int) Motion {
+	return spiral(centerX, centerY, radius, func(xMotion, yMotion int) (float64, int) {
+		return motionDistance(ref, candidate, smp, xMotion, yMotion)
+	})
+}
+
+// distanceFunc returns the distance of the images at the integer motion, and the number of pixels compared.
+type distanceFunc func(xMotion, yMotion int) (float64, int)
+
+// spiral walks in a spiral around (centerX, centerY) up to radius pixels and returns the motion with the smallest distance.
+func spiral(centerX, centerY, radius int, distance distanceFunc) Motion {
+	var bestXMotion, bestYMotion = centerX, centerY
+	var bestDist = math.MaxFloat64
+
+	side := 2*radius + 1
+	m2 := side * side
 
 	var xMotion, yMotion int
 	var dx, dy = 0, -1 // Direction.
 
 	directionChangeSinceImprovement := 0
 
-	smp := GetSampler(reference, ImageSamples)
-
 	var currentDist float64
+	var numberOfPixelsCompared int
 
 	// Based on: https://stackoverflow.com/questions/398299/looping-in-a-spiral
 	for i := 0; i < m2; i++ {
-		if (-max/2 < xMotion && xMotion <= max/2) && (-max/2 < yMotion && yMotion <= max/2) {
-			currentDist = 0
-			numberOfPixelsCompared := 0
-
-			smp.Reset()
-			for smp.HasMore() {
-				x, y := smp.Next()
-				if x+xMotion < bounds.Min.X || x+xMotion > bounds.Max.X ||
-					y+yMotion < bounds.Min.Y || y+yMotion > bounds.Max.Y {
-					//fmt.Printf("Out of bounds: %d %d\n", x, y)
-					// @todo why does it go out of bounds?
-					continue
-				}
-
-				referencePoint := ref.At(x, y)
-				candidatePoint := candidate.At(x+xMotion, y+yMotion)
-
-				d := distance(referencePoint, rgbaToColorful(candidatePoint))
-				currentDist += d * d
-				numberOfPixelsCompared++
-			}
-
-			currentDist = currentDist / float64(numberOfPixelsCompared)
+		if (-radius <= xMotion && xMotion <= radius) && (-radius <= yMotion && yMotion <= radius) {
+			currentDist, numberOfPixelsCompared = distance(centerX+xMotion, centerY+yMotion)
 
 			if numberOfPixelsCompared > 0 && currentDist < bestDist {
-				bestXMotion = xMotion
-				bestYMotion = yMotion
+				bestXMotion = centerX + xMotion
+				bestYMotion = centerY + yMotion
 				bestDist = currentDist
 				directionChangeSinceImprovement = 0
 			}
@@ -129,83 +283,101 @@ func estimateMotion(reference, candidate image.Image) Motion {
 
 		// If we haven't found an improvement for a long time, we give up.
 		if directionChangeSinceImprovement > MaxDirectionChangeSinceImprovement {
-			return Motion{X: bestXMotion, Y: bestYMotion, Diff: bestDist}
+			break
 		}
 	}
 
 	return Motion{X: bestXMotion, Y: bestYMotion, Diff: bestDist}
 }
 
-// GetSampler returns a sampling implementation for the image.
-// Comparing the whole picture would be too computational intensive, so we are forced to choose a subset of pixels to compare.
-func GetSampler(img image.Image, samples int) sampler.ImageSampler {
-	switch samplerName {
-	case "uniform":
-		return sampler.NewUniformSampler(img, samples)
-	case "edge":
-		// Although it's slow to calculate the edges, it gives us the best indication when the intensity will change, hence delivering the best result.
-		// Unlike the others it is determinstic.
-		return sampler.NewSamplerCache(sampler.NewEdgeDetector(img, samples))
-	case "gauss":
-		return sampler.NewSamplerCache(sampler.NewGaussSampler(img, samples))
-	default:
-		s1 := sampler.NewGaussSampler(img, samples/2)
-		s2 := sampler.NewEdgeDetector(img, samples/2)
-		s := sampler.NewCombinedSampler(img, samples, s1, s2)
-		return sampler.NewSamplerCache(s)
-	}
-}
+// motionDistance returns the mean square color difference between the reference and the candidate moved by (xMotion, yMotion).
+// The second return value is the number of pixels that could be compared.
+func motionDistance(ref, candidate *Frame, smp sampler.ImageSampler, xMotion, yMotion int) (float64, int) {
+	var dist float64
+	numberOfPixelsCompared := 0
+
+	smp.Reset()
+	for smp.HasMore() {
+		x, y := smp.Next()
+		// The samplers may return points on the edge of the image, outside of it.
+		if !image.Pt(x, y).In(ref.Rect) || !image.Pt(x+xMotion, y+yMotion).In(candidate.Rect) {
+			continue
+		}
 
-type ImageCache struct {
-	Img       image.Image
-	cache     map[int]map[int]colorful.Color
-	CacheHit  int
-	CacheMiss int
-}
+		l1, a1, b1 := ref.Lab(x, y)
+		l2, a2, b2 := candidate.Lab(x+xMotion, y+yMotion)
 
-func (ic *ImageCache) At(x, y int) (res colorful.Color) {
-	if cacheX, foundX := ic.cache[x]; foundX {
-		if res, foundY := cacheX[y]; foundY {
-			ic.CacheHit++
-			return res
-		}
-	} else {
-		ic.cache[x] = make(map[int]colorful.Color)
+		d := labDistance(l1, a1, b1, l2, a2, b2)
+		dist += d * d
+		numberOfPixelsCompared++
 	}
 
-	ic.CacheMiss++
-	color := rgbaToColorful(ic.Img.At(x, y))
-	ic.cache[x][y] = color
+	return dist / float64(numberOfPixelsCompared), numberOfPixelsCompared
+}
 
-	return color
+// refineMotion finds the sub-pixel motion around the best integer match.
+// It fits a parabola through the distances of the neighbouring pixels on both axes and takes its minimum.
+func refineMotion(ref, candidate *Frame, smp sampler.ImageSampler, m Motion) Motion {
+	return refine(m, func(xMotion, yMotion int) (float64, int) {
+		return motionDistance(ref, candidate, smp, xMotion, yMotion)
+	})
 }
 
-func NewImageCache(img image.Image) *ImageCache {
-	var ic ImageCache
+// refine finds the sub-pixel motion around the best integer match with the distance function (@see refineMotion).
+func refine(m Motion, distance distanceFunc) Motion {
+	left, _ := distance(m.X-1, m.Y)
+	right, _ := distance(m.X+1, m.Y)
+	m.SubX = parabolaMinimum(left, m.Diff, right)
 
-	ic.Img = img
-	ic.cache = make(map[int]map[int]colorful.Color, 0)
+	up, _ := distance(m.X, m.Y-1)
+	down, _ := distance(m.X, m.Y+1)
+	m.SubY = parabolaMinimum(up, m.Diff, down)
 
-	return &ic
+	return m
 }
 
-type MotionCache map[string]Motion
-
-func (ms MotionCache) WriteToFile(filename string) error {
-	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	if err := enc.Encode(ms); err != nil {
-		return err
+// parabolaMinimum returns the position of the minimum of the parabola going through (-1, prev), (0, curr) and (1, next).
+// The result is clamped to [-0.5, 0.5], as anything further away would have been found by the integer search.
+func parabolaMinimum(prev, curr, next float64) float64 {
+	denominator := prev - 2*curr + next
+	if denominator <= 0 || math.IsNaN(denominator) || math.IsInf(denominator, 0) {
+		return 0
 	}
 
-	return ioutil.WriteFile(filename, buf.Bytes(), os.FileMode(0666|os.O_CREATE|os.O_TRUNC))
+	offset := (prev - next) / (2 * denominator)
+
+	return math.Max(-0.5, math.Min(0.5, offset))
 }
 
-func (ms *MotionCache) ReadFromFile(filename string) error {
-	buf, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+// imageSampler returns the configured sampling implementation for the image.
+func (o *Options) imageSampler(img image.Image, samples int) sampler.ImageSampler {
+	return NewSampler(o.Sampler, img, samples, o.Seed)
+}
+
+// Samplers lists the valid names of NewSampler.
+var Samplers = []string{"gauss", "uniform", "edge", "combined"}
+
+// NewSampler returns a sampling implementation for the image by name.
+// Comparing the whole picture would be too computational intensive, so we are forced to choose a subset of pixels to compare.
+// Random samplers get their own source seeded with seed, so the same seed always samples the same pixels.
+func NewSampler(name string, img image.Image, samples int, seed int64) sampler.ImageSampler {
+	if f, ok := img.(*Frame); ok {
+		// The samplers only look at the intensity, converting the frame back to RGB on every access would be wasteful.
+		img = f.Gray()
 	}
 
-	return json.Unmarshal(buf, &ms)
+	switch name {
+	case "uniform":
+		return sampler.NewUniformSampler(img, samples)
+	case "edge":
+		// Although it's slow to calculate the edges, it gives us the best indication when the intensity will change, hence delivering the best result.
+		return sampler.NewSamplerCache(sampler.NewEdgeDetector(img, samples))
+	case "gauss":
+		return sampler.NewSamplerCache(sampler.NewGaussSampler(img, samples, rand.New(rand.NewSource(seed))))
+	default:
+		s1 := sampler.NewGaussSampler(img, samples/2, rand.New(rand.NewSource(seed)))
+		s2 := sampler.NewEdgeDetector(img, samples/2)
+		s := sampler.NewCombinedSampler(img, samples, s1, s2)
+		return sampler.NewSamplerCache(s)
+	}
 }
@@ -1,11 +1,14 @@
-package main
+package superres
 
 import (
 	"fmt"
 	"image"
 	_ "image/jpeg"
+	"math"
 	"os"
 	"testing"
+
+	"github.com/disintegration/imaging"
 )
 
 func TestMotionSameImage(t *testing.T) {
@@ -16,7 +19,8 @@ func TestMotionSameImage(t *testing.T) {
 		panic(err)
 	}
 
-	m := estimateMotion(img1, img1)
+	opts := DefaultOptions()
+	m := opts.estimateMotion(img1, img1)
 	if m.X != 0 || m.Y != 0 {
 		fmt.Printf("%#v\n", m)
 		t.Errorf("Same image should not detect motion")
@@ -31,9 +35,10 @@ func TestMotionSameImageUpscaled(t *testing.T) {
 		panic(err)
 	}
 
-	upscaled := upscale([]image.Image{img1})[0]
+	upscaled := upscale([]image.Image{img1}, 2, imaging.Gaussian)[0]
 
-	m := estimateMotion(upscaled, upscaled)
+	opts := DefaultOptions()
+	m := opts.estimateMotion(upscaled, upscaled)
 	if m.X != 0 || m.Y != 0 {
 		fmt.Printf("%#v\n", m)
 		t.Errorf("Same image should not detect motion")
@@ -55,9 +60,10 @@ func TestMotion(t *testing.T) {
 		panic(err)
 	}
 
-	m := estimateMotion(img1, img2)
+	opts := DefaultOptions()
+	m := opts.estimateMotion(img1, img2)
 	if m.X != 16 || m.Y != 22 {
-		t.Errof("Did not find correct motion for the example images")
+		t.Errorf("Did not find correct motion for the example images")
 	}
 }
 
@@ -76,9 +82,10 @@ func TestMotionUpscaled(t *testing.T) {
 		panic(err)
 	}
 
-	m := estimateMotion(upscale([]image.Image{img1})[0], upscale([]image.Image{img2})[0])
+	opts := DefaultOptions()
+	m := opts.estimateMotion(upscale([]image.Image{img1}, 2, imaging.Gaussian)[0], upscale([]image.Image{img2}, 2, imaging.Gaussian)[0])
 	if m.X != 32 || m.Y != 44 {
-		t.Errof("Did not find correct motion for the example images")
+		t.Errorf("Did not find correct motion for the example images")
 	}
 }
 
@@ -103,3 +110,97 @@ func TestOutliers(t *testing.T) {
 		t.Errorf("Could not mark first item as outlier")
 	}
 }
+
+func TestParabolaMinimum(t *testing.T) {
+	if m := parabolaMinimum(1.0, 0.0, 1.0); m != 0 {
+		t.Errorf("Symmetric neighbours should not move the minimum, got %f", m)
+	}
+
+	if m := parabolaMinimum(2.0, 1.0, 1.5); m <= 0 || m > 0.5 {
+		t.Errorf("Minimum should move towards the smaller neighbour, got %f", m)
+	}
+
+	if m := parabolaMinimum(0.0, 1.0, 0.0); m != 0 {
+		t.Errorf("A maximum should not be refined, got %f", m)
+	}
+}
+
+func TestMotionPyramidWideSearch(t *testing.T) {
+	file1, _ := os.Open("motion_1.jpg")
+	defer file1.Close()
+	img1, _, err := image.Decode(file1)
+	if err != nil {
+		panic(err)
+	}
+
+	file2, _ := os.Open("motion_2.jpg")
+	defer file2.Close()
+	img2, _, err := image.Decode(file2)
+	if err != nil {
+		panic(err)
+	}
+
+	m := estimatePyramidMotion(img1, img2, EstimatorOptions{PyramidLevels: 5, SearchRange: 0.2})
+	if m.X != 16 || m.Y != 22 {
+		fmt.Printf("%#v\n", m)
+		t.Errorf("Did not find correct motion for the example images with a wide search range")
+	}
+}
+
+func TestMotionInverse(t *testing.T) {
+	bounds := image.Rect(0, 0, 640, 480)
+	rotation := normalizedTransform("similarity", []float64{0.01, -0.02, 0.03, 0.01}, bounds)
+
+	for _, m := range []Motion{{X: 3, Y: -2, SubX: 0.25}, {Transform: &rotation}} {
+		x, y := m.Apply(100, 200)
+		if rx, ry := m.Inverse(x, y); math.Abs(rx-100) > 1e-9 || math.Abs(ry-200) > 1e-9 {
+			t.Errorf("%s: inverse should map back to 100 200, got %f %f", m, rx, ry)
+		}
+	}
+}
+
+func TestMotionScale(t *testing.T) {
+	bounds := image.Rect(0, 0, 640, 480)
+	rotation := normalizedTransform("euclidean", []float64{0.01, -0.02, 0.03}, bounds)
+
+	for _, m := range []Motion{{X: 3, Y: -2, SubX: 0.25}, {Transform: &rotation}} {
+		scaled := m.Scale(2)
+
+		// Pixel centers in the input are at l, in the scaled image at 2*l+0.5.
+		x, y := m.Apply(100, 200)
+		sx, sy := scaled.Apply(200.5, 400.5)
+		if math.Abs(sx-(2*x+0.5)) > 1e-9 || math.Abs(sy-(2*y+0.5)) > 1e-9 {
+			t.Errorf("%s: scaled motion should move %f %f, got %f %f", m, 2*x+0.5, 2*y+0.5, sx, sy)
+		}
+	}
+}
+
+func TestMotionScaleRoundTrip(t *testing.T) {
+	bounds := image.Rect(0, 0, 640, 480)
+	rotation := normalizedTransform("similarity", []float64{0.01, -0.02, 0.03, 0.01}, bounds)
+
+	for _, m := range []Motion{{X: 3, Y: -2, SubX: 0.25}, {Transform: &rotation}} {
+		roundTrip := m.Scale(1.5).Scale(1 / 1.5)
+
+		x, y := m.Apply(100, 200)
+		if rx, ry := roundTrip.Apply(100, 200); math.Abs(rx-x) > 1e-9 || math.Abs(ry-y) > 1e-9 {
+			t.Errorf("%s: scaling back and forth should keep the motion %f %f, got %f %f", m, x, y, rx, ry)
+		}
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	filter, err := GetFilter("lanczos")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upscaled := upscale([]image.Image{image.NewNRGBA(image.Rect(0, 0, 101, 60))}, 1.5, filter)[0]
+	if upscaled.Bounds().Dx() != 152 || upscaled.Bounds().Dy() != 90 {
+		t.Errorf("Upscaling 101x60 by 1.5 should be 152x90, got %v", upscaled.Bounds())
+	}
+
+	if _, err := GetFilter("sinc"); err == nil {
+		t.Errorf("Unknown filter should be an error")
+	}
+}
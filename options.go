@@ -0,0 +1,229 @@
+package superres
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+)
+
+// Options configures Process.
+// Start from DefaultOptions, the zero value is not a valid configuration.
+type Options struct {
+	// Scale is the working resolution relative to the input, 1 merges the frames at the input resolution.
+	Scale float64
+
+	// OutputScale is the resolution of the output relative to the input.
+	OutputScale float64
+
+	// UpscaleFilter and OutputFilter are the resampling filters to upscale the frames and to resize the output with (@see GetFilter).
+	UpscaleFilter string
+	OutputFilter  string
+
+	// Sharpen the output image.
+	Sharpen bool
+
+	// MergeMethod merges the pixels of the frames (@see GetColorMerge).
+	// Kappa and ClipIterations configure the sigma clipped mean, TrimPercent the trimmed and winsorized means.
+	MergeMethod    string
+	Kappa          float64
+	ClipIterations int
+	TrimPercent    float64
+
+	// Estimator is the name of the motion estimator (@see GetEstimator), the rest configures it (@see EstimatorOptions).
+	Estimator     string
+	Sampler       string
+	Seed          int64
+	PyramidLevels int
+	SearchRange   float64
+
+	// Interpolation samples the frames at sub-pixel motion (@see GetInterpolator).
+	Interpolation string
+
+	// Transform is the model to align the frames with (@see TransformModels).
+	Transform string
+
+	// TileSize is the size of the tiles to align locally, at least minTileSize, 0 aligns the whole frame.
+	// The tile displacement fields are written to TileDebug, unless it's empty.
+	TileSize  int
+	TileDebug string
+
+	// Reference selects the frame to align the others to (@see selectReference).
+	Reference string
+
+	// Chain registers every frame against its predecessor, re-anchoring every Reanchor-th frame against the reference (0 disables).
+	Chain    bool
+	Reanchor int
+
+	// IBPIterations is the number of iterative back-projection iterations to refine the merged image with (0 disables).
+	IBPIterations int
+	IBPStep       float64
+	PSFSigma      float64
+
+	// Drizzle the frames onto the working resolution grid with drops of DropSize input pixels, instead of upscaling them before the merge.
+	Drizzle  bool
+	DropSize float64
+
+	// Deghost is the color distance to the reference above which the blocks of GhostBlock pixels of a frame are left out of the merge (0 disables).
+	// The masks grow by GhostDilation blocks, and are written to GhostMaskDir, unless it's empty.
+	Deghost       float64
+	GhostBlock    int
+	GhostDilation int
+	GhostMaskDir  string
+
+	// Normalize the exposure and white balance of the frames against the reference.
+	Normalize bool
+
+	// HDR merges an exposure-bracketed burst into a radiance map instead of using MergeMethod.
+	HDR bool
+
+	// MemoryLimit is the memory in bytes the frames may take, larger bursts are merged in strips streamed from disk (0 disables).
+	MemoryLimit int64
+
+	// CacheMode is the use of the motion cache in CacheDir (@see CacheModes).
+	CacheMode string
+	CacheDir  string
+
+	// Parallelism is the number of goroutines of every stage.
+	Parallelism int
+
+	// Log receives the progress messages, the detailed ones only if Verbose is set. A nil Log discards them.
+	Log     io.Writer
+	Verbose bool
+
+	// OnProgress receives the progress of every stage, nil doesn't report it.
+	// It is called from the workers of the stage, one call at a time, so it should return quickly.
+	OnProgress func(Progress)
+}
+
+// DefaultOptions returns the options of the command line, without -fast.
+func DefaultOptions() Options {
+	return Options{
+		Scale:          2,
+		OutputScale:    1,
+		UpscaleFilter:  "gaussian",
+		OutputFilter:   "catmullrom",
+		Sharpen:        true,
+		MergeMethod:    "average",
+		Kappa:          2.5,
+		ClipIterations: 3,
+		TrimPercent:    10,
+		Estimator:      DefaultEstimator,
+		Sampler:        "combined",
+		Seed:           DefaultSeed,
+		PyramidLevels:  DefaultPyramidLevels,
+		SearchRange:    maxMotion,
+		Interpolation:  "bilinear",
+		Transform:      "translation",
+		Reference:      "first",
+		Reanchor:       10,
+		IBPStep:        1.0,
+		PSFSigma:       1.0,
+		DropSize:       0.7,
+		GhostBlock:     4,
+		GhostDilation:  2,
+		CacheMode:      "readwrite",
+		CacheDir:       defaultCacheDir(),
+		Parallelism:    runtime.NumCPU(),
+		Verbose:        true,
+	}
+}
+
+// Validate checks the options, Process calls it before loading any frame.
+func (o *Options) Validate() error {
+	if o.Scale < 1 || o.OutputScale <= 0 {
+		return fmt.Errorf("invalid scale %f and output scale %f, the scale has to be at least 1 and the output scale positive", o.Scale, o.OutputScale)
+	}
+
+	if _, err := GetFilter(o.UpscaleFilter); err != nil {
+		return err
+	}
+
+	if _, err := GetFilter(o.OutputFilter); err != nil {
+		return err
+	}
+
+	if o.Deghost > 0 && (o.Drizzle || o.GhostBlock < 1 || o.GhostDilation < 0) {
+		return fmt.Errorf("invalid deghosting with %d pixel blocks dilated by %d, the block size has to be positive, the dilation can't be negative and the drizzle can't deghost", o.GhostBlock, o.GhostDilation)
+	}
+
+	if o.HDR && (o.Drizzle || o.IBPIterations > 0 || o.Deghost > 0 || o.Normalize) {
+		return fmt.Errorf("the HDR merge weights the frames by their exposure itself, it can't drizzle, back-project, deghost or normalize the frames")
+	}
+
+	if o.CacheMode != "off" && o.CacheMode != "read" && o.CacheMode != "readwrite" {
+		return fmt.Errorf("invalid cache mode %s, valid modes are %s", o.CacheMode, strings.Join(CacheModes, ", "))
+	}
+
+	if o.PyramidLevels < 1 || o.SearchRange < 0 {
+		return fmt.Errorf("invalid motion search over %d pyramid levels and %f of the image, there has to be at least one level and the range can't be negative", o.PyramidLevels, o.SearchRange)
+	}
+
+	if o.TileSize != 0 && o.TileSize < minTileSize {
+		return fmt.Errorf("invalid tile size %d, the tiles have to be at least %d pixels, or 0 to align the whole frame", o.TileSize, minTileSize)
+	}
+
+	if !validName(o.Sampler, Samplers) {
+		return fmt.Errorf("invalid sampler %s, valid samplers are %s", o.Sampler, strings.Join(Samplers, ", "))
+	}
+
+	if !validName(o.Interpolation, Interpolations) {
+		return fmt.Errorf("invalid interpolation %s, valid interpolations are %s", o.Interpolation, strings.Join(Interpolations, ", "))
+	}
+
+	if _, err := transformParameters(o.Transform); err != nil {
+		return err
+	}
+
+	if _, err := GetEstimator(o.Estimator); err != nil {
+		return err
+	}
+
+	_, err := GetColorMerge(o.MergeMethod, o.Kappa, o.ClipIterations, o.TrimPercent)
+
+	return err
+}
+
+// validName tells whether the name is one of the names.
+func validName(name string, names []string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logf writes the message to the log.
+func (o *Options) logf(format string, args ...interface{}) {
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, format, args...)
+	}
+}
+
+// verbosef writes the detailed message to the log, only if verbose.
+func (o *Options) verbosef(format string, args ...interface{}) {
+	if o.Verbose {
+		o.logf(format, args...)
+	}
+}
+
+// estimatorOptions returns the configuration of the motion estimator.
+func (o *Options) estimatorOptions() EstimatorOptions {
+	return EstimatorOptions{
+		Sampler:       o.Sampler,
+		PyramidLevels: o.PyramidLevels,
+		SearchRange:   o.SearchRange,
+		Seed:          o.Seed,
+	}
+}
+
+// workers returns the number of goroutines of a stage, at least one.
+func (o *Options) workers() int {
+	if o.Parallelism < 1 {
+		return 1
+	}
+
+	return o.Parallelism
+}
@@ -0,0 +1,41 @@
+package superres
+
+import (
+	"image"
+	"sync"
+)
+
+// parallel calls fn with every index from 0 to n-1 on workers goroutines, at least one, and returns once every call returned.
+func parallel(workers, n int, fn func(i int)) {
+	parallelWorkers(workers, n, func() func(i int) {
+		return fn
+	})
+}
+
+// parallelWorkers is parallel with a function of its own for every goroutine, made by newWorker, so a worker can reuse its buffers between the indices.
+func parallelWorkers(workers, n int, newWorker func() func(i int)) {
+	jobQueue := make(chan int, n)
+	for i := 0; i < n; i++ {
+		jobQueue <- i
+	}
+	close(jobQueue)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers || w == 0; w++ {
+		wg.Add(1)
+		go func(work func(i int)) {
+			defer wg.Done()
+			for i := range jobQueue {
+				work(i)
+			}
+		}(newWorker())
+	}
+	wg.Wait()
+}
+
+// parallelRows calls fn with every row of the rectangle on workers goroutines.
+func parallelRows(workers int, r image.Rectangle, fn func(y int)) {
+	parallel(workers, r.Dy(), func(i int) {
+		fn(r.Min.Y + i)
+	})
+}
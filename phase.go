@@ -0,0 +1,116 @@
+package superres
+
+import (
+	"image"
+	"math"
+	"math/cmplx"
+)
+
+// estimatePhaseCorrelation finds the translation between the images from the peak of their normalized cross-power spectrum.
+// Unlike the spiral search it is not limited by the search range, it finds any translation smaller than half of the image.
+// The Diff of the motion is one minus the height of the correlation peak, so a confident match has a Diff close to 0.
+func estimatePhaseCorrelation(reference, candidate image.Image) Motion {
+	bounds := reference.Bounds()
+	width, height := nextPowerOfTwo(bounds.Dx()), nextPowerOfTwo(bounds.Dy())
+
+	ref := windowedLuminance(reference, width, height)
+	cand := windowedLuminance(candidate, width, height)
+	fft2(ref, width, height, false)
+	fft2(cand, width, height, false)
+
+	for i := range cand {
+		c := cand[i] * cmplx.Conj(ref[i])
+		if magnitude := cmplx.Abs(c); magnitude > 1e-12 {
+			cand[i] = c / complex(magnitude, 0)
+		} else {
+			cand[i] = 0
+		}
+	}
+	fft2(cand, width, height, true)
+
+	peak := 0
+	for i := range cand {
+		if real(cand[i]) > real(cand[peak]) {
+			peak = i
+		}
+	}
+
+	peakX, peakY := peak%width, peak/width
+	at := func(x, y int) float64 {
+		return -real(cand[((y+height)%height)*width+(x+width)%width])
+	}
+
+	m := Motion{
+		X:    wrapShift(peakX, width),
+		Y:    wrapShift(peakY, height),
+		Diff: 1 - real(cand[peak]),
+	}
+	m.SubX = parabolaMinimum(at(peakX-1, peakY), at(peakX, peakY), at(peakX+1, peakY))
+	m.SubY = parabolaMinimum(at(peakX, peakY-1), at(peakX, peakY), at(peakX, peakY+1))
+
+	return m
+}
+
+// wrapShift converts the circular position of the correlation peak to a signed shift.
+func wrapShift(position, size int) int {
+	if position > size/2 {
+		return position - size
+	}
+
+	return position
+}
+
+// windowedLuminance returns the zero-mean luminance of the image multiplied by a Hann window, zero-padded to width*height.
+// The window suppresses the edges of the image, which would otherwise dominate the correlation.
+func windowedLuminance(img image.Image, width, height int) []complex128 {
+	bounds := img.Bounds()
+	luminance := imageLuminance(img)
+
+	var mean float64
+	for _, l := range luminance {
+		mean += l
+	}
+	mean /= float64(len(luminance))
+
+	data := make([]complex128, width*height)
+	for y := 0; y < bounds.Dy(); y++ {
+		wy := hann(y, bounds.Dy())
+		for x := 0; x < bounds.Dx(); x++ {
+			data[y*width+x] = complex((luminance[y*bounds.Dx()+x]-mean)*wy*hann(x, bounds.Dx()), 0)
+		}
+	}
+
+	return data
+}
+
+// imageLuminance returns the luminance of the pixels in row-major order.
+// Frames already hold their lightness, so they are not converted back to RGB.
+func imageLuminance(img image.Image) []float64 {
+	bounds := img.Bounds()
+	luminance := make([]float64, bounds.Dx()*bounds.Dy())
+
+	if f, ok := img.(*Frame); ok {
+		for i, l := range f.L {
+			luminance[i] = float64(l)
+		}
+
+		return luminance
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			luminance[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] = (0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / 65535.0
+		}
+	}
+
+	return luminance
+}
+
+func hann(i, n int) float64 {
+	if n <= 1 {
+		return 1
+	}
+
+	return 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+}
@@ -0,0 +1,54 @@
+package superres
+
+import (
+	"image"
+	"math"
+	"math/cmplx"
+	"os"
+	"testing"
+)
+
+func TestFFTRoundTrip(t *testing.T) {
+	data := []complex128{1, 2, 3, 4, 0, -1, 5, 2}
+	transformed := make([]complex128, len(data))
+	copy(transformed, data)
+
+	fft(transformed, false)
+	if cmplx.Abs(transformed[0]-16) > 1e-9 {
+		t.Errorf("DC component should be the sum of the data, got %v", transformed[0])
+	}
+
+	fft(transformed, true)
+	for i := range data {
+		if cmplx.Abs(transformed[i]-data[i]) > 1e-9 {
+			t.Errorf("Inverse transform should restore the data, got %v at %d instead of %v", transformed[i], i, data[i])
+		}
+	}
+}
+
+func TestPhaseCorrelation(t *testing.T) {
+	file1, _ := os.Open("motion_1.jpg")
+	defer file1.Close()
+	img1, _, err := image.Decode(file1)
+	if err != nil {
+		panic(err)
+	}
+
+	file2, _ := os.Open("motion_2.jpg")
+	defer file2.Close()
+	img2, _, err := image.Decode(file2)
+	if err != nil {
+		panic(err)
+	}
+
+	m := estimatePhaseCorrelation(img1, img2)
+	x, y := m.Offset()
+	if math.Abs(x-16) > 1 || math.Abs(y-22) > 1 {
+		t.Errorf("Did not find correct motion for the example images: %s", m)
+	}
+
+	same := estimatePhaseCorrelation(img1, img1)
+	if same.X != 0 || same.Y != 0 {
+		t.Errorf("Same image should not detect motion: %s", same)
+	}
+}
@@ -0,0 +1,149 @@
+package superres
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	colorful "github.com/lucasb-eyer/go-colorful"
+)
+
+const (
+	// Linear channel values above which a sample counts as clipped, and is left out of the photometric fit.
+	photometricClipped = 0.95
+
+	// Fewest samples of a channel the photometric fit needs, below it the channel is left as is.
+	minPhotometricSamples = 16
+)
+
+// PhotometricCorrection maps the channels of a frame onto the reference in linear light, every channel c becoming Gain*c + Offset.
+// It undoes the exposure and white balance flicker of a burst, which would make the color distances of the motion estimation and the merge large.
+type PhotometricCorrection struct {
+	Gain   [3]float64
+	Offset [3]float64
+}
+
+// identityCorrection leaves the frame as is.
+func identityCorrection() PhotometricCorrection {
+	return PhotometricCorrection{Gain: [3]float64{1, 1, 1}}
+}
+
+func (pc PhotometricCorrection) String() string {
+	return fmt.Sprintf("gain r:%.3f g:%.3f b:%.3f offset r:%.3f g:%.3f b:%.3f", pc.Gain[0], pc.Gain[1], pc.Gain[2], pc.Offset[0], pc.Offset[1], pc.Offset[2])
+}
+
+// IsIdentity tells whether the correction leaves the frame as is.
+func (pc PhotometricCorrection) IsIdentity() bool {
+	return pc == identityCorrection()
+}
+
+// Apply returns the corrected image, clipping it like a camera would, on workers goroutines.
+func (pc PhotometricCorrection) Apply(img image.Image, workers int) *image.NRGBA {
+	bounds := img.Bounds()
+	res := image.NewNRGBA(bounds)
+	parallelRows(workers, bounds, func(y int) {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b := rgbaToColorful(img.At(x, y)).LinearRgb()
+			c := colorful.LinearRgb(pc.channel(0, r), pc.channel(1, g), pc.channel(2, b))
+			res.SetNRGBA(x, y, color.NRGBA{R: floatChannel(c.R), G: floatChannel(c.G), B: floatChannel(c.B), A: 255})
+		}
+	})
+
+	return res
+}
+
+func (pc PhotometricCorrection) channel(ch int, v float64) float64 {
+	return math.Max(0, math.Min(1, pc.Gain[ch]*v+pc.Offset[ch]))
+}
+
+// estimatePhotometric fits the correction of the candidate against the reference on uniformly sampled points (@see NewSampler).
+// The frames are not aligned yet, so instead of pairing the samples by position it pairs the quantiles of the samples of every channel,
+// which the small motion of a burst barely changes, and fits the gain and offset of every channel with least squares.
+// The edge samplers would pick the points where the motion changes the colors the most, biasing the quantiles.
+// The seed seeds the sampler like the one of the motion estimation.
+func estimatePhotometric(reference, candidate image.Image, seed int64) PhotometricCorrection {
+	var refSamples, candSamples [3][]float64
+
+	bounds := reference.Bounds()
+	smp := NewSampler("uniform", reference, ImageSamples, seed)
+	for smp.HasMore() {
+		x, y := smp.Next()
+		if !image.Pt(x, y).In(bounds) || !image.Pt(x, y).In(candidate.Bounds()) {
+			continue
+		}
+
+		rr, rg, rb := rgbaToColorful(reference.At(x, y)).LinearRgb()
+		cr, cg, cb := rgbaToColorful(candidate.At(x, y)).LinearRgb()
+		for ch, v := range [3]float64{rr, rg, rb} {
+			refSamples[ch] = append(refSamples[ch], v)
+		}
+		for ch, v := range [3]float64{cr, cg, cb} {
+			candSamples[ch] = append(candSamples[ch], v)
+		}
+	}
+
+	pc := identityCorrection()
+	for ch := range refSamples {
+		sort.Float64s(refSamples[ch])
+		sort.Float64s(candSamples[ch])
+
+		if gain, offset, ok := fitLine(candSamples[ch], refSamples[ch]); ok {
+			pc.Gain[ch], pc.Offset[ch] = gain, offset
+		}
+	}
+
+	return pc
+}
+
+// fitLine returns the least squares fit of ys = gain*xs + offset over the pairs where neither value is clipped.
+func fitLine(xs, ys []float64) (gain, offset float64, ok bool) {
+	var n, sumX, sumY, sumXX, sumXY float64
+	for i := range xs {
+		if xs[i] >= photometricClipped || ys[i] >= photometricClipped {
+			continue
+		}
+
+		n++
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXX += xs[i] * xs[i]
+		sumXY += xs[i] * ys[i]
+	}
+
+	variance := n*sumXX - sumX*sumX
+	if n < minPhotometricSamples || variance <= 1e-12 {
+		return 1, 0, false
+	}
+
+	gain = (n*sumXY - sumX*sumY) / variance
+	offset = (sumY - gain*sumX) / n
+
+	return gain, offset, gain > 0
+}
+
+// normalizePhotometric corrects every frame against the first one, the reference, and returns the corrections, the reference's being the identity.
+// The corrected images replace the originals in place. A canceled normalization returns the error of the context.
+func (o *Options) normalizePhotometric(ctx context.Context, imageNames []string, images []image.Image) ([]PhotometricCorrection, error) {
+	corrections := make([]PhotometricCorrection, len(images))
+	corrections[0] = identityCorrection()
+
+	progress := o.startStage(StageNormalize, len(images)-1, 0)
+	for i := 1; i < len(images); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		corrections[i] = estimatePhotometric(images[0], images[i], o.Seed)
+		o.verbosef("Photometric correction: %s\t %s\n", imageNames[i], corrections[i])
+
+		if !corrections[i].IsIdentity() {
+			images[i] = corrections[i].Apply(images[i], o.workers())
+		}
+		progress.addFrames(1)
+	}
+
+	return corrections, nil
+}
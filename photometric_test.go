@@ -0,0 +1,65 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"math"
+	"testing"
+)
+
+func TestEstimatePhotometric(t *testing.T) {
+	bounds := image.Rect(0, 0, 160, 120)
+	reference := texture(bounds, 0, 0)
+
+	// Brighter, warmer, with a raised black level and moved a little.
+	flicker := PhotometricCorrection{Gain: [3]float64{1.3, 1.1, 0.8}, Offset: [3]float64{0.02, 0, 0.01}}
+	candidate := flicker.Apply(texture(bounds, 2, 1), 2)
+
+	pc := estimatePhotometric(reference, candidate, DefaultSeed)
+	for ch := range pc.Gain {
+		// The correction is the inverse of the flicker.
+		gain, offset := 1/flicker.Gain[ch], -flicker.Offset[ch]/flicker.Gain[ch]
+		if math.Abs(pc.Gain[ch]/gain-1) > 0.05 || math.Abs(pc.Offset[ch]-offset) > 0.01 {
+			t.Errorf("Channel %d should be corrected with gain %f and offset %f, got %s", ch, gain, offset, pc)
+		}
+	}
+}
+
+func TestEstimatePhotometricIdentity(t *testing.T) {
+	bounds := image.Rect(0, 0, 160, 120)
+	pc := estimatePhotometric(texture(bounds, 0, 0), texture(bounds, 0, 0), DefaultSeed)
+
+	for ch := range pc.Gain {
+		if math.Abs(pc.Gain[ch]-1) > 1e-6 || math.Abs(pc.Offset[ch]) > 1e-6 {
+			t.Errorf("The same frame should not be corrected, got %s", pc)
+		}
+	}
+}
+
+func TestPhotometricMotionDiff(t *testing.T) {
+	bounds := image.Rect(0, 0, 160, 120)
+	reference := texture(bounds, 0, 0)
+	flickered := PhotometricCorrection{Gain: [3]float64{1.4, 1.2, 0.9}}.Apply(texture(bounds, 3, 2), 2)
+
+	opts := DefaultOptions()
+	images := []image.Image{reference, flickered}
+	raw := opts.estimateMotion(reference, flickered)
+
+	corrections, err := opts.normalizePhotometric(context.Background(), []string{"reference", "flickered"}, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if corrections[0] != identityCorrection() || images[1] == image.Image(flickered) {
+		t.Fatal("Only the candidate should be corrected, in place")
+	}
+
+	corrected := opts.estimateMotion(reference, images[1])
+	if corrected.Diff >= raw.Diff/2 {
+		t.Errorf("The correction should reduce the color distance of the alignment, from %f to %f", raw.Diff, corrected.Diff)
+	}
+
+	if corrected.X != 3 || corrected.Y != 2 {
+		t.Errorf("The corrected frame should move by 3, 2, got %s", corrected)
+	}
+}
@@ -0,0 +1,543 @@
+package superres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	sharpenSigma = 0.5
+)
+
+// Result is the outcome of Process.
+type Result struct {
+	// Image is the merged image at the output resolution, tone mapped for an HDR merge.
+	Image *image.NRGBA
+
+	// Radiance is the radiance map of an HDR merge at the output resolution, nil otherwise.
+	Radiance *Radiance
+
+	// Reference is the index of the frame the others were aligned to.
+	Reference int
+
+	// Motions holds the motion of every frame relative to the reference, in input pixels.
+	Motions []Motion
+
+	// Rejected lists the indices of the frames pulled from the merge for being too different from the others.
+	Rejected []int
+
+	Stats Stats
+}
+
+// Stats describes how a Process run went.
+// The per frame values are indexed like the frames, the ones a run didn't compute are nil.
+type Stats struct {
+	// InputBounds are the bounds of the input frames.
+	InputBounds image.Rectangle
+
+	// Streamed is set when the frames were merged in strips because they didn't fit in Options.MemoryLimit.
+	Streamed bool
+
+	// CachedMotions is the number of motions read from the motion cache instead of estimated.
+	CachedMotions int
+
+	// Corrections are the photometric corrections of the frames with Options.Normalize.
+	Corrections []PhotometricCorrection
+
+	// Exposures are the exposures of the frames relative to the reference in an HDR merge.
+	Exposures []float64
+
+	// GhostCoverage is the ratio of every merged frame the ghost masks rejected.
+	GhostCoverage []float64
+
+	// Residuals are the mean residuals of the back-projection iterations.
+	Residuals []float64
+
+	// Duration is the wall time of the run.
+	Duration time.Duration
+}
+
+// Process merges the frames, read from the named image files, into one image of higher resolution.
+// Every setting comes from the options, so concurrent calls with different options don't interfere.
+// Every stage checks the context regularly, a canceled run stops early and returns the error of the context.
+func Process(ctx context.Context, frames []string, opts Options) (*Result, error) {
+	start := time.Now()
+
+	if len(frames) == 0 {
+		return nil, errors.New("no frames to merge")
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	colorMergeMethod, _ := GetColorMerge(opts.MergeMethod, opts.Kappa, opts.ClipIterations, opts.TrimPercent)
+	upscaleResampleFilter, _ := GetFilter(opts.UpscaleFilter)
+	outputResampleFilter, _ := GetFilter(opts.OutputFilter)
+
+	// The pipeline swaps the reference to the front, the caller's slice is left as is.
+	imageNames := append([]string(nil), frames...)
+
+	footprint, err := inMemoryFootprint(imageNames, opts.Scale)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *Result
+	if opts.MemoryLimit > 0 && footprint > opts.MemoryLimit {
+		if opts.Drizzle || opts.IBPIterations > 0 || opts.Deghost > 0 || opts.HDR {
+			return nil, fmt.Errorf("the frames need %d MB in memory, more than the limit of %d MB, and the drizzle, the back-projection, the deghosting and the HDR merge can't stream them", footprint>>20, opts.MemoryLimit>>20)
+		}
+
+		opts.verbosef("Streaming the merge, the frames would need %d MB in memory\n", footprint>>20)
+		res, err = opts.streamMerge(ctx, imageNames, colorMergeMethod, GetInterpolator(opts.Interpolation), opts.MergeMethod == "average")
+	} else if opts.HDR {
+		res, err = opts.mergeHDR(ctx, imageNames, upscaleResampleFilter)
+	} else {
+		res, err = opts.mergeInMemory(ctx, imageNames, colorMergeMethod, upscaleResampleFilter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	outputWidth, outputHeight := opts.outputSize(res.Stats.InputBounds)
+	if res.Radiance != nil {
+		// The radiance is kept as is, without sharpening it.
+		res.Radiance.img = res.Radiance.img.resize(outputWidth, outputHeight)
+	}
+
+	if opts.Sharpen {
+		res.Image = imaging.Sharpen(res.Image, sharpenSigma)
+	}
+
+	if res.Image.Bounds().Dx() != outputWidth || res.Image.Bounds().Dy() != outputHeight {
+		res.Image = imaging.Resize(res.Image, outputWidth, outputHeight, outputResampleFilter)
+	}
+
+	res.Stats.Duration = time.Since(start)
+
+	return res, nil
+}
+
+// outputSize returns the size of the output for the input bounds.
+func (o *Options) outputSize(inputBounds image.Rectangle) (int, int) {
+	return int(math.Round(float64(inputBounds.Dx()) * o.OutputScale)), int(math.Round(float64(inputBounds.Dy()) * o.OutputScale))
+}
+
+// inputIndex returns the index of the frame at i among the frames as given, once the reference was swapped with the first frame.
+func inputIndex(reference, i int) int {
+	switch i {
+	case 0:
+		return reference
+	case reference:
+		return 0
+	}
+
+	return i
+}
+
+// setRegistration fills the reference, the motions and the rejected frames of the result.
+// The motions and the kept frames are in the order of the pipeline, with the reference swapped to the front.
+func (r *Result) setRegistration(reference int, motionCorrection []Motion, kept []int) {
+	r.Reference = reference
+	r.Motions = make([]Motion, len(motionCorrection))
+	for i := range motionCorrection {
+		r.Motions[inputIndex(reference, i)] = motionCorrection[i]
+	}
+
+	merged := make(map[int]bool, len(kept))
+	for _, k := range kept {
+		merged[k] = true
+	}
+
+	for i := range motionCorrection {
+		if !merged[i] {
+			r.Rejected = append(r.Rejected, inputIndex(reference, i))
+		}
+	}
+	sort.Ints(r.Rejected)
+}
+
+// mergeInMemory loads every frame, upscales them and merges them.
+// It returns the merged image at the working resolution.
+func (o *Options) mergeInMemory(ctx context.Context, images []string, colorMergeMethod ColorMerge, upscaleResampleFilter imaging.ResampleFilter) (*Result, error) {
+	loadedImages, err := loadImages(ctx, images, o.startStage(StageLoad, len(images), 0))
+	if err != nil {
+		return nil, err
+	}
+
+	referenceIndex, err := o.selectReference(images, loadedImages)
+	if err != nil {
+		return nil, err
+	}
+
+	o.moveReferenceFirst(images, referenceIndex, loadedImages)
+
+	res := &Result{}
+	if o.Normalize {
+		corrections, err := o.normalizePhotometric(ctx, images, loadedImages)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Stats.Corrections = make([]PhotometricCorrection, len(corrections))
+		for i := range corrections {
+			res.Stats.Corrections[inputIndex(referenceIndex, i)] = corrections[i]
+		}
+	}
+
+	// Keep the frames at the input resolution for the back-projection, upscale replaces them in place.
+	observedImages := append([]image.Image(nil), loadedImages...)
+	res.Stats.InputBounds = loadedImages[0].Bounds()
+
+	// Drizzle deposits the frames onto the finer grid itself, so it works on the images as observed.
+	workingScale := o.Scale
+	if o.Drizzle {
+		workingScale = 1
+	}
+
+	if workingScale != 1 {
+		loadedImages = upscale(loadedImages, workingScale, upscaleResampleFilter)
+	}
+
+	// The motion estimation and the merge compare the colors in Lab, so the images are converted only once.
+	frames := NewFrames(loadedImages, o.workers())
+
+	// The motion is in input pixels from here on.
+	motionCorrection, cached, err := o.getMotionCorrection(ctx, images, frames, referenceIndex, workingScale)
+	if err != nil {
+		return nil, err
+	}
+	res.Stats.CachedMotions = cached
+
+	kept := o.framesToMerge(images, motionCorrection)
+	res.setRegistration(referenceIndex, motionCorrection, kept)
+
+	keptNames := make([]string, len(kept))
+	keptImages := make([]image.Image, len(kept))
+	keptObserved := make([]image.Image, len(kept))
+	keptFrames := make([]*Frame, len(kept))
+	keptMotion := make([]Motion, len(kept))
+	for i, k := range kept {
+		keptNames[i] = images[k]
+		keptImages[i], keptObserved[i], keptFrames[i], keptMotion[i] = loadedImages[k], observedImages[k], frames[k], motionCorrection[k]
+	}
+
+	if o.Drizzle {
+		res.Image = drizzle(ctx, keptImages, keptMotion, o.Scale, o.DropSize, o.startStage(StageMerge, len(keptImages), 0))
+	} else {
+		motions := scaleMotions(keptMotion, o.Scale)
+
+		var masks []*GhostMask
+		if o.Deghost > 0 {
+			if masks, err = o.ghostMasks(ctx, keptNames, keptFrames, motions); err != nil {
+				return nil, err
+			}
+
+			res.Stats.GhostCoverage = make([]float64, len(images))
+			for i := 1; i < len(masks); i++ {
+				res.Stats.GhostCoverage[inputIndex(referenceIndex, kept[i])] = masks[i].Coverage()
+			}
+		}
+
+		bounds := keptFrames[0].Bounds()
+		progress := o.startStage(StageMerge, 0, int64(bounds.Dx())*int64(bounds.Dy()))
+		res.Image = superres(ctx, keptFrames, motions, masks, colorMergeMethod, GetInterpolator(o.Interpolation), o.workers(), progress)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if o.IBPIterations > 0 {
+		bounds := keptObserved[0].Bounds()
+		progress := o.startStage(StageBackProject, 0, int64(o.IBPIterations)*int64(len(keptObserved))*int64(bounds.Dx())*int64(bounds.Dy()))
+		res.Image, res.Stats.Residuals = backProject(ctx, res.Image, keptObserved, scaleMotions(keptMotion, o.Scale), o.Scale, o.IBPIterations, o.IBPStep, o.PSFSigma, progress)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for i := range res.Stats.Residuals {
+			o.verbosef("Back-projection iteration %d:\t residual %f\n", i+1, res.Stats.Residuals[i])
+		}
+	}
+
+	return res, nil
+}
+
+// ghostMasks estimates the ghost masks of the frames with the configured threshold, reports how much of every frame they reject and writes them out for inspection if asked to.
+// The motions are in working pixels.
+func (o *Options) ghostMasks(ctx context.Context, imageNames []string, frames []*Frame, motionCorrection []Motion) ([]*GhostMask, error) {
+	progress := o.startStage(StageDeghost, len(frames)-1, 0)
+	masks := estimateGhostMasks(ctx, frames, motionCorrection, GetInterpolator(o.Interpolation), o.Deghost, o.GhostBlock, o.GhostDilation, o.workers(), progress)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(masks); i++ {
+		o.verbosef("Ghost mask: %s\t %.1f%% rejected\n", imageNames[i], masks[i].Coverage()*100)
+
+		if o.GhostMaskDir != "" {
+			filename := filepath.Join(o.GhostMaskDir, filepath.Base(imageNames[i])+".ghost.png")
+			if err := masks[i].WriteToFile(filename); err != nil {
+				o.logf("Could not write ghost mask %s: %s\n", filename, err)
+			}
+		}
+	}
+
+	return masks, nil
+}
+
+// framesToMerge returns the indices of the frames to merge, pulling the ones that are too different from the others (@see getOutliers).
+// The reference is always kept.
+func (o *Options) framesToMerge(imageNames []string, motionCorrection []Motion) []int {
+	outliers := make(map[int]bool)
+	for _, index := range getOutliers(motionCorrection) {
+		if index == 0 {
+			o.logf("Keeping reference %s, although it's too different (Diff: %f)\n", imageNames[index], motionCorrection[index].Diff)
+			continue
+		}
+
+		o.logf("Pulling %s, because it's too different (Diff: %f)\n", imageNames[index], motionCorrection[index].Diff)
+		outliers[index] = true
+	}
+
+	var kept []int
+	for i := range motionCorrection {
+		if !outliers[i] {
+			kept = append(kept, i)
+		}
+	}
+
+	return kept
+}
+
+// getMotionCorrection estimates the motion of every image relative to the first one.
+// The first image is the reference, swapped to the front from its index among the images as given (@see inputIndex).
+// The images are scaled by scale relative to the input, the returned (and cached) motions are in input pixels.
+// It also returns how many of the motions came from the cache.
+// A canceled registration returns the error of the context, without caching the motions.
+func (o *Options) getMotionCorrection(ctx context.Context, imageNames []string, imgs []*Frame, reference int, scale float64) ([]Motion, int, error) {
+	motionCorrection := make([]Motion, len(imgs))
+
+	// Without a cache every motion is missing.
+	var motionCache *MotionCache
+	var keys []string
+	if o.CacheMode == "read" || o.CacheMode == "readwrite" {
+		var err error
+		if motionCache, err = OpenMotionCache(o.CacheDir); err != nil {
+			// Saving the fresh cache replaces the unreadable one.
+			o.logf("Could not read the motion cache, starting a new one: %s\n", err)
+			motionCache = newMotionCache()
+		}
+		keys = o.motionCacheKeys(imageNames, reference, scale)
+	}
+
+	o.logf("Reference %s:\t 0 0\n", imageNames[0])
+
+	var missing []int
+	for i := 1; i < len(imgs); i++ {
+		if motion, found := motionCache.Get(cacheKey(keys, i)); found {
+			motionCorrection[i] = motion.Scale(scale)
+			o.verbosef("Cached motion: %s\t %s \t Diff: %f\n", imageNames[i], motion, motion.Diff)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	// The tiles are a second pass over the frames.
+	passes := 1
+	if o.TileSize > 0 {
+		passes = 2
+	}
+	progress := o.startStage(StageRegister, passes*len(missing), 0)
+
+	if o.Chain {
+		o.chainMotion(ctx, imgs, motionCorrection, missing, reference, progress)
+	} else {
+		runMotionWorkers(ctx, o.workers(), missing, motionCorrection, progress, func(i int) Motion {
+			return o.registerFrame(imgs[0], imgs[i])
+		})
+	}
+
+	if o.TileSize > 0 {
+		runMotionWorkers(ctx, o.workers(), missing, motionCorrection, progress, func(i int) Motion {
+			motion := motionCorrection[i]
+			motion.Tiles = o.estimateTiles(imgs[0], imgs[i], motion)
+			return motion
+		})
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for i := range motionCorrection {
+		motionCorrection[i] = motionCorrection[i].Scale(1 / scale)
+	}
+
+	for _, i := range missing {
+		motionCache.Put(cacheKey(keys, i), motionCorrection[i])
+		o.verbosef("Motion calculated: %s\t %s \t Diff: %f\n", imageNames[i], motionCorrection[i], motionCorrection[i].Diff)
+	}
+
+	if o.TileDebug != "" {
+		for i := range motionCorrection {
+			if motionCorrection[i].Tiles == nil {
+				continue
+			}
+
+			filename := filepath.Join(o.TileDebug, filepath.Base(imageNames[i])+".tiles.png")
+			if err := motionCorrection[i].Tiles.WriteToFile(filename); err != nil {
+				o.logf("Could not write tile displacement field %s: %s\n", filename, err)
+			}
+		}
+	}
+
+	if motionCache != nil && o.CacheMode == "readwrite" {
+		if err := motionCache.Save(o.CacheDir); err != nil {
+			o.logf("Could not write the motion cache: %s\n", err)
+		}
+	}
+
+	return motionCorrection, len(imgs) - 1 - len(missing), nil
+}
+
+// registerFrame estimates the motion of the candidate relative to the reference with the configured estimator and transform model.
+func (o *Options) registerFrame(reference, candidate image.Image) Motion {
+	motion, err := estimateTransform(reference, candidate, o.estimateMotion(reference, candidate), o.Transform)
+	if err != nil {
+		panic(err)
+	}
+
+	return motion
+}
+
+// runMotionWorkers calculates the motion of the frames on workers goroutines, and stores them in motionCorrection.
+// Once the context is canceled the frames left keep their motion.
+func runMotionWorkers(ctx context.Context, workers int, frames []int, motionCorrection []Motion, progress *progressTracker, work func(i int) Motion) {
+	parallel(workers, len(frames), func(j int) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		i := frames[j]
+		motionCorrection[i] = work(i)
+		progress.addFrames(1)
+	})
+}
+
+// loadImages decodes the images, checking the context between them, and that they are all the same size.
+func loadImages(ctx context.Context, images []string, progress *progressTracker) ([]image.Image, error) {
+	var loadedImages []image.Image
+	for i := range images {
+		if err := ctx.Err(); err != nil {
+			return loadedImages, err
+		}
+
+		decoded, err := loadImage(images[i])
+		if err != nil {
+			return loadedImages, err
+		}
+
+		if i > 0 {
+			if err := checkFrameSize(images, i, decoded, loadedImages[0].Bounds().Size()); err != nil {
+				return loadedImages, err
+			}
+		}
+
+		loadedImages = append(loadedImages, decoded)
+		progress.addFrames(1)
+	}
+
+	return loadedImages, nil
+}
+
+// checkFrameSize returns an error if the image i of the images is not of the size of the first one.
+func checkFrameSize(images []string, i int, img image.Image, size image.Point) error {
+	if img.Bounds().Size() != size {
+		return fmt.Errorf("%s is %v, every image has to be the same size as %s", images[i], img.Bounds().Size(), images[0])
+	}
+
+	return nil
+}
+
+func loadImage(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoded, _, err := image.Decode(f)
+
+	return decoded, err
+}
+
+// upscale resizes the images to scale times the size of the first image.
+func upscale(images []image.Image, scale float64, filter imaging.ResampleFilter) []image.Image {
+	bounds := images[0].Bounds()
+	width := int(math.Round(float64(bounds.Dx()) * scale))
+	height := int(math.Round(float64(bounds.Dy()) * scale))
+
+	for i := range images {
+		images[i] = imaging.Resize(images[i], width, height, filter)
+	}
+
+	return images
+}
+
+// scaleMotions converts the motions from input pixels to an image scaled by factor.
+func scaleMotions(motions []Motion, factor float64) []Motion {
+	scaled := make([]Motion, len(motions))
+	for i := range motions {
+		scaled[i] = motions[i].Scale(factor)
+	}
+
+	return scaled
+}
+
+// FilterNames lists the valid names of GetFilter.
+var FilterNames = []string{"nearest", "box", "linear", "hermite", "mitchell", "catmullrom", "bspline", "gaussian", "lanczos"}
+
+// GetFilter returns the resampling filter by name.
+func GetFilter(name string) (imaging.ResampleFilter, error) {
+	switch name {
+	case "nearest":
+		return imaging.NearestNeighbor, nil
+	case "box":
+		return imaging.Box, nil
+	case "linear":
+		return imaging.Linear, nil
+	case "hermite":
+		return imaging.Hermite, nil
+	case "mitchell":
+		return imaging.MitchellNetravali, nil
+	case "catmullrom":
+		return imaging.CatmullRom, nil
+	case "bspline":
+		return imaging.BSpline, nil
+	case "gaussian":
+		return imaging.Gaussian, nil
+	case "lanczos":
+		return imaging.Lanczos, nil
+	default:
+		return imaging.ResampleFilter{}, fmt.Errorf("unknown resampling filter %q, valid filters: %s", name, strings.Join(FilterNames, ", "))
+	}
+}
@@ -0,0 +1,189 @@
+package superres
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeBurst writes the texture moved by every shift as a PNG, and returns the file names.
+func writeBurst(t *testing.T, bounds image.Rectangle, shifts []image.Point) []string {
+	dir := t.TempDir()
+
+	var names []string
+	for i, shift := range shifts {
+		name := filepath.Join(dir, strconv.Itoa(i)+".png")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, texture(bounds, float64(shift.X), float64(shift.Y))); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// testOptions returns the default options without the motion cache.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.CacheMode = "off"
+	opts.Sampler = "uniform"
+
+	return opts
+}
+
+func TestProcess(t *testing.T) {
+	bounds := image.Rect(0, 0, 128, 96)
+	frames := writeBurst(t, bounds, []image.Point{{0, 0}, {2, -1}, {-1, 2}})
+	given := append([]string(nil), frames...)
+
+	opts := testOptions()
+	opts.Reference = "1"
+	res, err := Process(context.Background(), frames, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range frames {
+		if frames[i] != given[i] {
+			t.Fatal("Process should not reorder the frames of the caller")
+		}
+	}
+
+	if res.Image.Bounds().Dx() != 128 || res.Image.Bounds().Dy() != 96 || res.Stats.InputBounds != bounds {
+		t.Errorf("Expected a 128x96 output of 128x96 inputs, got %v of %v", res.Image.Bounds(), res.Stats.InputBounds)
+	}
+
+	if res.Reference != 1 || len(res.Motions) != 3 {
+		t.Fatalf("Expected the second frame as reference and 3 motions, got %d and %d", res.Reference, len(res.Motions))
+	}
+
+	// The motions are relative to the reference, in the order of the frames.
+	for i, expected := range [][2]float64{{-2, 1}, {0, 0}, {-3, 3}} {
+		if x, y := res.Motions[i].Offset(); math.Abs(x-expected[0]) > 0.5 || math.Abs(y-expected[1]) > 0.5 {
+			t.Errorf("Frame %d should move by %v, got %s", i, expected, res.Motions[i])
+		}
+	}
+
+	if res.Stats.Streamed || res.Stats.CachedMotions != 0 || res.Stats.Duration <= 0 {
+		t.Errorf("Unexpected stats %+v", res.Stats)
+	}
+}
+
+func TestProcessConcurrentOptions(t *testing.T) {
+	bounds := image.Rect(0, 0, 96, 64)
+	frames := writeBurst(t, bounds, []image.Point{{0, 0}, {2, 1}})
+
+	expected, err := Process(context.Background(), frames, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []int{1, 3} {
+		p := p
+		t.Run(fmt.Sprintf("parallelism=%d", p), func(t *testing.T) {
+			t.Parallel()
+
+			opts := testOptions()
+			opts.Parallelism = p
+			res, err := Process(context.Background(), frames, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(res.Image.Pix, expected.Image.Pix) {
+				t.Errorf("Concurrent runs on %d workers should be identical", p)
+			}
+		})
+
+		t.Run(fmt.Sprintf("scale=%d", p+1), func(t *testing.T) {
+			t.Parallel()
+
+			opts := testOptions()
+			opts.Scale, opts.OutputScale = float64(p+1), float64(p+1)
+			res, err := Process(context.Background(), frames, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Image.Bounds().Dx() != 96*(p+1) {
+				t.Errorf("Expected an output %d times larger, got %v", p+1, res.Image.Bounds())
+			}
+		})
+	}
+}
+
+func TestProcessInvalidOptions(t *testing.T) {
+	frames := writeBurst(t, image.Rect(0, 0, 32, 32), []image.Point{{0, 0}})
+
+	invalid := map[string]func(*Options){
+		"scale":         func(o *Options) { o.Scale = 0.5 },
+		"filter":        func(o *Options) { o.UpscaleFilter = "missing" },
+		"merge":         func(o *Options) { o.MergeMethod = "missing" },
+		"estimator":     func(o *Options) { o.Estimator = "missing" },
+		"transform":     func(o *Options) { o.Transform = "missing" },
+		"sampler":       func(o *Options) { o.Sampler = "missing" },
+		"pyramid":       func(o *Options) { o.PyramidLevels = 0 },
+		"search range":  func(o *Options) { o.SearchRange = -0.1 },
+		"tile":          func(o *Options) { o.TileSize = -8 },
+		"small tile":    func(o *Options) { o.TileSize = 8 },
+		"interpolation": func(o *Options) { o.Interpolation = "missing" },
+		"cache":         func(o *Options) { o.CacheMode = "missing" },
+		"hdr":           func(o *Options) { o.HDR, o.Drizzle = true, true },
+	}
+
+	for name, invalidate := range invalid {
+		opts := testOptions()
+		invalidate(&opts)
+		if _, err := Process(context.Background(), frames, opts); err == nil {
+			t.Errorf("%s: invalid options should return an error", name)
+		}
+	}
+
+	if _, err := Process(context.Background(), nil, testOptions()); err == nil {
+		t.Error("Processing no frames should return an error")
+	}
+}
+
+func TestProcessFrameSizes(t *testing.T) {
+	frames := writeBurst(t, image.Rect(0, 0, 64, 48), []image.Point{{0, 0}, {1, 1}})
+	frames = append(frames, writeBurst(t, image.Rect(0, 0, 48, 48), []image.Point{{0, 0}})...)
+
+	// A limit of a single byte streams the frames.
+	paths := map[string]func(*Options){
+		"memory": func(o *Options) {},
+		"stream": func(o *Options) { o.MemoryLimit = 1 },
+		"hdr":    func(o *Options) { o.HDR, o.Scale = true, 1 },
+	}
+
+	for name, configure := range paths {
+		opts := testOptions()
+		configure(&opts)
+		if _, err := Process(context.Background(), frames, opts); err == nil || !strings.Contains(err.Error(), "same size") {
+			t.Errorf("%s: frames of different sizes should be refused, got %v", name, err)
+		}
+	}
+}
+
+func TestProcessCanceled(t *testing.T) {
+	frames := writeBurst(t, image.Rect(0, 0, 64, 48), []image.Point{{0, 0}, {1, 1}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := Process(ctx, frames, testOptions()); err != context.Canceled {
+		t.Errorf("A canceled run should return the error of the context, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package superres
+
+import (
+	"sync"
+)
+
+// Stages of a Process run, in the order they run. A run skips the stages its options don't need.
+const (
+	StageLoad        = "load"
+	StageNormalize   = "normalize"
+	StageRegister    = "register"
+	StageDeghost     = "deghost"
+	StageMerge       = "merge"
+	StageBackProject = "backproject"
+)
+
+// Progress is how far the current stage of a Process run is.
+// A stage working frame by frame counts frames, one working on the output counts pixels, the other total is 0.
+type Progress struct {
+	Stage string
+
+	Frames      int
+	TotalFrames int
+
+	Pixels      int64
+	TotalPixels int64
+}
+
+// Fraction returns how much of the stage is done, from 0 to 1.
+func (p Progress) Fraction() float64 {
+	switch {
+	case p.TotalPixels > 0:
+		return float64(p.Pixels) / float64(p.TotalPixels)
+	case p.TotalFrames > 0:
+		return float64(p.Frames) / float64(p.TotalFrames)
+	default:
+		return 1
+	}
+}
+
+// progressTracker counts the work done in a stage and reports it to Options.OnProgress.
+// The workers of a stage share it, the reports are serialized so they never go backwards.
+// A nil tracker reports nothing.
+type progressTracker struct {
+	mu       sync.Mutex
+	progress Progress
+	report   func(Progress)
+}
+
+// startStage reports the start of the stage, with the frames and the pixels it has to do.
+func (o *Options) startStage(stage string, frames int, pixels int64) *progressTracker {
+	if o.OnProgress == nil {
+		return nil
+	}
+
+	pt := &progressTracker{
+		progress: Progress{Stage: stage, TotalFrames: frames, TotalPixels: pixels},
+		report:   o.OnProgress,
+	}
+	pt.report(pt.progress)
+
+	return pt
+}
+
+// addFrames reports n more frames done.
+func (pt *progressTracker) addFrames(n int) {
+	if pt == nil {
+		return
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.progress.Frames += n
+	pt.report(pt.progress)
+}
+
+// addPixels reports n more pixels done.
+func (pt *progressTracker) addPixels(n int64) {
+	if pt == nil {
+		return
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.progress.Pixels += n
+	pt.report(pt.progress)
+}
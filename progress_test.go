@@ -0,0 +1,127 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessProgress(t *testing.T) {
+	frames := writeBurst(t, image.Rect(0, 0, 96, 64), []image.Point{{0, 0}, {2, 1}, {-1, 2}})
+
+	var reports []Progress
+	opts := testOptions()
+	opts.Parallelism = 3
+	opts.OnProgress = func(p Progress) {
+		reports = append(reports, p)
+	}
+
+	if _, err := Process(context.Background(), frames, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var stages []string
+	for i, p := range reports {
+		if i == 0 || p.Stage != reports[i-1].Stage {
+			stages = append(stages, p.Stage)
+			if p.Fraction() != 0 && p.TotalFrames+int(p.TotalPixels) > 0 {
+				t.Errorf("%s: the stage should start at 0, got %+v", p.Stage, p)
+			}
+			continue
+		}
+
+		if p.Frames < reports[i-1].Frames || p.Pixels < reports[i-1].Pixels {
+			t.Errorf("%s: the progress should never go backwards, got %+v after %+v", p.Stage, p, reports[i-1])
+		}
+	}
+
+	expected := []string{StageLoad, StageRegister, StageMerge}
+	if len(stages) != len(expected) {
+		t.Fatalf("Expected the stages %v, got %v", expected, stages)
+	}
+	for i := range expected {
+		if stages[i] != expected[i] {
+			t.Fatalf("Expected the stages %v, got %v", expected, stages)
+		}
+	}
+
+	last := reports[len(reports)-1]
+	if last.Stage != StageMerge || last.Pixels != 96*2*64*2 || last.Fraction() != 1 {
+		t.Errorf("The merge should end with every pixel of the working resolution done, got %+v", last)
+	}
+}
+
+func TestProcessCanceledDuringRegistration(t *testing.T) {
+	frames := writeBurst(t, image.Rect(0, 0, 96, 64), []image.Point{{0, 0}, {2, 1}, {-1, 2}, {1, -1}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var once sync.Once
+	opts := testOptions()
+	opts.CacheMode, opts.CacheDir = "readwrite", t.TempDir()
+	opts.OnProgress = func(p Progress) {
+		if p.Stage == StageRegister {
+			once.Do(cancel)
+		}
+
+		if p.Stage == StageMerge {
+			t.Error("A canceled run should not reach the merge")
+		}
+	}
+
+	if _, err := Process(ctx, frames, opts); err != context.Canceled {
+		t.Fatalf("A canceled run should return the error of the context, got %v", err)
+	}
+
+	mc, err := OpenMotionCache(opts.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.Entries) != 0 {
+		t.Errorf("A canceled registration should not cache its motions, got %d", len(mc.Entries))
+	}
+}
+
+func TestProcessDeadline(t *testing.T) {
+	frames := writeBurst(t, image.Rect(0, 0, 64, 48), []image.Point{{0, 0}, {1, 1}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	if _, err := Process(ctx, frames, testOptions()); err != context.DeadlineExceeded {
+		t.Errorf("A run past its deadline should return the error of the context, got %v", err)
+	}
+}
+
+func TestSuperresCanceled(t *testing.T) {
+	images, motions := mergeFrames(150, 70, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var pixels int64
+	opts := Options{OnProgress: func(p Progress) { pixels = p.Pixels }}
+	superres(ctx, images, motions, nil, averageColor, bilinearInterpolation, 2, opts.startStage(StageMerge, 0, 150*70))
+	if pixels != 0 {
+		t.Errorf("A canceled merge should not merge any tile, merged %d pixels", pixels)
+	}
+}
+
+func TestProgressFraction(t *testing.T) {
+	for _, test := range []struct {
+		progress Progress
+		expected float64
+	}{
+		{Progress{Frames: 1, TotalFrames: 4}, 0.25},
+		{Progress{Pixels: 30, TotalPixels: 40}, 0.75},
+		{Progress{}, 1},
+	} {
+		if f := test.progress.Fraction(); f != test.expected {
+			t.Errorf("%+v should be %f done, got %f", test.progress, test.expected, f)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package superres
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// Longest side of the proxies used to estimate the motion between every frame when selecting the reference by motion.
+const referenceProxySize = 512
+
+// moveReferenceFirst swaps the reference to the front of the image names and of every slice of the frames,
+// the rest of the pipeline expects the reference to be the first frame (@see inputIndex).
+func (o *Options) moveReferenceFirst(images []string, reference int, frames ...interface{}) {
+	o.logf("Selected reference %s (%s)\n", images[reference], o.Reference)
+
+	images[0], images[reference] = images[reference], images[0]
+	for _, f := range frames {
+		reflect.Swapper(f)(0, reference)
+	}
+}
+
+// selectReference returns the index of the reference frame.
+// The configured reference is either "first", "sharpness" (the highest variance of the Laplacian), "motion" (the smallest total motion to every other frame),
+// or pins the reference by its index or file name.
+func (o *Options) selectReference(imageNames []string, imgs []image.Image) (int, error) {
+	mode := o.Reference
+	switch mode {
+	case "first", "":
+		return 0, nil
+	case "sharpness":
+		best, bestSharpness := 0, -1.0
+		for i := range imgs {
+			sharpness := laplacianVariance(imgs[i])
+			o.verbosef("Sharpness: %s\t %f\n", imageNames[i], sharpness)
+			if sharpness > bestSharpness {
+				best, bestSharpness = i, sharpness
+			}
+		}
+
+		return best, nil
+	case "motion":
+		return centralFrame(imgs), nil
+	}
+
+	if index, err := strconv.Atoi(mode); err == nil {
+		if index < 0 || index >= len(imgs) {
+			return 0, fmt.Errorf("reference index %d is out of range, there are %d images", index, len(imgs))
+		}
+
+		return index, nil
+	}
+
+	for i, name := range imageNames {
+		if name == mode || filepath.Base(name) == mode {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown reference %q, use first, sharpness, motion, an index or a file name", mode)
+}
+
+// laplacianVariance measures the sharpness of the image as the variance of the Laplacian of its luminance.
+// Blurry frames have less high frequency detail, hence a smaller variance.
+func laplacianVariance(img image.Image) float64 {
+	gray := imaging.Grayscale(img)
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	at := func(x, y int) float64 {
+		return float64(gray.Pix[y*gray.Stride+x*4])
+	}
+
+	var sum, sumSquares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			l := at(x-1, y) + at(x+1, y) + at(x, y-1) + at(x, y+1) - 4*at(x, y)
+			sum += l
+			sumSquares += l * l
+		}
+	}
+
+	n := float64((width - 2) * (height - 2))
+	mean := sum / n
+
+	return sumSquares/n - mean*mean
+}
+
+// centralFrame returns the frame with the smallest total motion to every other frame.
+// The motion of every frame is estimated on small proxies against the first frame, and the motion between two frames is the difference of theirs.
+func centralFrame(imgs []image.Image) int {
+	proxies := make([]image.Image, len(imgs))
+	for i := range imgs {
+		proxies[i] = imaging.Fit(imgs[i], referenceProxySize, referenceProxySize, imaging.Box)
+	}
+
+	motions := make([]Motion, len(imgs))
+	for i := 1; i < len(imgs); i++ {
+		motions[i] = estimatePhaseCorrelation(proxies[0], proxies[i])
+	}
+
+	best, bestTotal := 0, math.MaxFloat64
+	for i := range motions {
+		var total float64
+		for j := range motions {
+			x1, y1 := motions[i].Offset()
+			x2, y2 := motions[j].Offset()
+			total += math.Hypot(x2-x1, y2-y1)
+		}
+
+		if total < bestTotal {
+			best, bestTotal = i, total
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,96 @@
+package superres
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestSelectReference(t *testing.T) {
+	sharp := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x/4+y/4)%2 == 0 {
+				sharp.Pix[y*sharp.Stride+x*4] = 255
+				sharp.Pix[y*sharp.Stride+x*4+1] = 255
+				sharp.Pix[y*sharp.Stride+x*4+2] = 255
+			}
+			sharp.Pix[y*sharp.Stride+x*4+3] = 255
+		}
+	}
+	blurry := imaging.Blur(sharp, 2)
+
+	names := []string{"dir/blurry.jpg", "dir/sharp.jpg", "dir/blurrier.jpg"}
+	imgs := []image.Image{blurry, sharp, imaging.Blur(sharp, 4)}
+
+	tests := []struct {
+		mode     string
+		expected int
+	}{
+		{mode: "first", expected: 0},
+		{mode: "sharpness", expected: 1},
+		{mode: "2", expected: 2},
+		{mode: "sharp.jpg", expected: 1},
+		{mode: "dir/blurrier.jpg", expected: 2},
+	}
+
+	opts := DefaultOptions()
+	for _, test := range tests {
+		opts.Reference = test.mode
+		index, err := opts.selectReference(names, imgs)
+		if err != nil {
+			t.Errorf("%s: %s", test.mode, err)
+		}
+
+		if index != test.expected {
+			t.Errorf("%s: expected reference %d, got %d", test.mode, test.expected, index)
+		}
+	}
+
+	for _, mode := range []string{"3", "-1", "missing.jpg"} {
+		opts.Reference = mode
+		if _, err := opts.selectReference(names, imgs); err == nil {
+			t.Errorf("%s: invalid reference should return an error", mode)
+		}
+	}
+}
+
+func TestSelectReferenceByMotion(t *testing.T) {
+	shifted := func(dx int) image.Image {
+		img := image.NewGray(image.Rect(0, 0, 128, 128))
+		for y := 0; y < 128; y++ {
+			for x := 0; x < 128; x++ {
+				v := 2 + math.Sin(float64(x-dx)/7) + math.Cos(float64(y)/9)*math.Sin(float64(x-dx+y)/13)
+				img.Pix[y*img.Stride+x] = uint8(v * 60)
+			}
+		}
+
+		return img
+	}
+
+	// The middle frame is the closest to every other.
+	imgs := []image.Image{shifted(0), shifted(10), shifted(5)}
+	opts := DefaultOptions()
+	opts.Reference = "motion"
+	index, err := opts.selectReference([]string{"a", "b", "c"}, imgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index != 2 {
+		t.Errorf("Expected the middle frame as reference, got %d", index)
+	}
+}
+
+func TestMoveReferenceFirst(t *testing.T) {
+	images := []string{"a", "b", "c"}
+	exposures := []float64{1, 2, 3}
+
+	var o Options
+	o.moveReferenceFirst(images, 2, exposures)
+	if images[0] != "c" || images[2] != "a" || exposures[0] != 3 || exposures[2] != 1 || exposures[1] != 2 {
+		t.Errorf("Expected the reference swapped to the front of every slice, got %v %v", images, exposures)
+	}
+}
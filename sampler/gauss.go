@@ -3,7 +3,6 @@ package sampler
 import (
 	"image"
 	"math/rand"
-	"time"
 )
 
 type GaussSampler struct {
@@ -12,6 +11,7 @@ type GaussSampler struct {
 	RemainingSamples int
 
 	bounds image.Rectangle
+	rand   *rand.Rand
 }
 
 func (rs GaussSampler) HasMore() bool {
@@ -24,20 +24,21 @@ func (rs *GaussSampler) Next() (x, y int) {
 	xMax := float64(rs.bounds.Max.X) / 2.0
 	yMax := float64(rs.bounds.Max.Y) / 2.0
 
-	return int(rand.NormFloat64()*(xMax/5) + xMax), int(rand.NormFloat64()*(yMax/5) + yMax)
+	return int(rs.rand.NormFloat64()*(xMax/5) + xMax), int(rs.rand.NormFloat64()*(yMax/5) + yMax)
 }
 
 func (rs *GaussSampler) Reset() {
 	rs.RemainingSamples = rs.MaxSamples
 }
 
-func NewGaussSampler(img image.Image, samples int) *GaussSampler {
-	rand.Seed(time.Now().UTC().UnixNano())
+// NewGaussSampler creates a sampler drawing its points from rnd, so a seeded source makes the points reproducible.
+func NewGaussSampler(img image.Image, samples int, rnd *rand.Rand) *GaussSampler {
 	return &GaussSampler{
 		Reference:        img,
 		RemainingSamples: samples,
 		MaxSamples:       samples,
 		bounds:           img.Bounds(),
+		rand:             rnd,
 	}
 }
 
@@ -45,5 +46,4 @@ func NewGaussSampler(img image.Image, samples int) *GaussSampler {
 
 //func combineSamplers(...Sampler) Sampler
 
-//@TODO seed properly
 //@TODO Check different image sizes
@@ -0,0 +1,33 @@
+package sampler
+
+import (
+	"image"
+)
+
+// OffsetSampler moves every point of the wrapped sampler by a fixed offset.
+// It allows sampling a region of an image with a sampler created for the cropped region.
+type OffsetSampler struct {
+	Sampler ImageSampler
+	Offset  image.Point
+}
+
+func (os OffsetSampler) HasMore() bool {
+	return os.Sampler.HasMore()
+}
+
+func (os *OffsetSampler) Next() (x, y int) {
+	x, y = os.Sampler.Next()
+
+	return x + os.Offset.X, y + os.Offset.Y
+}
+
+func (os *OffsetSampler) Reset() {
+	os.Sampler.Reset()
+}
+
+func NewOffsetSampler(sampler ImageSampler, offset image.Point) *OffsetSampler {
+	return &OffsetSampler{
+		Sampler: sampler,
+		Offset:  offset,
+	}
+}
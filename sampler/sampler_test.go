@@ -6,6 +6,7 @@ import (
 	"image/color"
 	_ "image/jpeg"
 	"image/png"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -31,11 +32,25 @@ func TestRandomSampler(t *testing.T) {
 func TestGaussSampler(t *testing.T) {
 	bounds := image.Rect(0, 0, 1024, 768)
 	output := image.NewNRGBA(bounds)
-	us := NewGaussSampler(output, 1024)
+	us := NewGaussSampler(output, 1024, rand.New(rand.NewSource(1)))
 
 	renderSampler(us, output, "gauss.png")
 }
 
+func TestGaussSamplerSeed(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 768))
+	s1 := NewGaussSampler(img, 128, rand.New(rand.NewSource(42)))
+	s2 := NewGaussSampler(img, 128, rand.New(rand.NewSource(42)))
+
+	for s1.HasMore() {
+		x1, y1 := s1.Next()
+		x2, y2 := s2.Next()
+		if x1 != x2 || y1 != y2 {
+			t.Fatalf("Samplers with the same seed should return the same points, got %d %d and %d %d", x1, y1, x2, y2)
+		}
+	}
+}
+
 func TestEdgeDetector(t *testing.T) {
 	file, _ := os.Open("milana.jpg")
 	defer file.Close()
@@ -40,7 +40,7 @@ func (us *UniformSampler) Next() (x, y int) {
 }
 
 func (us *UniformSampler) Reset() {
-	us = NewUniformSampler(us.Reference, us.XSamples*us.XSamples)
+	*us = *NewUniformSampler(us.Reference, us.XSamples*us.YSamples)
 }
 
 func NewUniformSampler(img image.Image, samples int) *UniformSampler {
@@ -53,8 +53,16 @@ func NewUniformSampler(img image.Image, samples int) *UniformSampler {
 	stepX := bounds.Max.X / xSamples
 	stepY := bounds.Max.Y / ySamples
 
-	startX := (bounds.Max.X / xSamples) / 2
-	startY := (bounds.Max.Y / ySamples) / 2
+	// Images smaller than the samples get every pixel sampled, instead of never moving on.
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+
+	startX := stepX / 2
+	startY := stepY / 2
 
 	us := UniformSampler{
 		Reference: img,
@@ -0,0 +1,110 @@
+package superres
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestReproducibleRuns(t *testing.T) {
+	file1, _ := os.Open("motion_1.jpg")
+	defer file1.Close()
+	img1, _, err := image.Decode(file1)
+	if err != nil {
+		panic(err)
+	}
+
+	file2, _ := os.Open("motion_2.jpg")
+	defer file2.Close()
+	img2, _, err := image.Decode(file2)
+	if err != nil {
+		panic(err)
+	}
+
+	// The combined sampler mixes random and edge samples, so it depends on the seed the most.
+	images := []image.Image{imaging.Resize(img1, 480, 270, imaging.Box), imaging.Resize(img2, 480, 270, imaging.Box)}
+	options := EstimatorOptions{
+		Sampler:       "combined",
+		PyramidLevels: DefaultPyramidLevels,
+		SearchRange:   maxMotion,
+		Seed:          1234,
+	}
+
+	run := func() (Motion, []byte) {
+		m := estimatePyramidMotion(images[0], images[1], options)
+		output := superres(context.Background(), NewFrames(images, 2), []Motion{{}, m}, nil, averageColor, bilinearInterpolation, 2, nil)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, output); err != nil {
+			panic(err)
+		}
+
+		return m, buf.Bytes()
+	}
+
+	m1, output1 := run()
+	m2, output2 := run()
+
+	if m1 != m2 {
+		t.Errorf("Same seed should estimate the same motion, got %s and %s", m1, m2)
+	}
+
+	if !bytes.Equal(output1, output2) {
+		t.Errorf("Same seed should produce byte-identical output")
+	}
+}
+
+func TestReproducibleProcess(t *testing.T) {
+	// The sub-pixel shifts leave a distance after the registration, which depends on the sampled pixels.
+	bounds := image.Rect(0, 0, 96, 64)
+	dir := t.TempDir()
+	var frames []string
+	for i, shift := range []float64{0.3, 1.6} {
+		name := filepath.Join(dir, strconv.Itoa(i)+".png")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, texture(bounds, shift, shift/2)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		frames = append(frames, name)
+	}
+
+	run := func(seed int64) (*Result, []byte) {
+		opts := testOptions()
+		opts.Sampler, opts.Seed, opts.Parallelism = "gauss", seed, 4
+
+		res, err := Process(context.Background(), frames, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, res.Image); err != nil {
+			t.Fatal(err)
+		}
+
+		return res, buf.Bytes()
+	}
+
+	res1, output1 := run(1234)
+	_, output2 := run(1234)
+	if !bytes.Equal(output1, output2) {
+		t.Error("Same seed should produce byte-identical output")
+	}
+
+	// Another seed samples other pixels, so the registration compares other colors.
+	res3, _ := run(4321)
+	if res1.Motions[1].Diff == res3.Motions[1].Diff {
+		t.Errorf("Another seed should sample other pixels, got the same distance %f", res1.Motions[1].Diff)
+	}
+}
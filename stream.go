@@ -0,0 +1,335 @@
+package superres
+
+import (
+	"context"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Margin in input pixels around the rows a strip of the output maps to, so the interpolation has the neighbouring pixels.
+	streamRowMargin = 3
+
+	// Fewest output rows merged at once, however low the memory limit is.
+	minStreamRows = 8
+
+	// The motion of a strip is evaluated on a grid with this step in output pixels to find the input rows it maps to.
+	streamGridStep = 8
+
+	// Bytes of a pixel of a frame in memory, decoded and converted to Lab.
+	frameBytesPerPixel = 4 + 12
+)
+
+// inMemoryFootprint estimates the memory in bytes the frames take when merging them in memory, from the size of the first image.
+// Every frame is kept decoded, upscaled to the working resolution and converted to Lab, next to the output.
+func inMemoryFootprint(images []string, scale float64) (int64, error) {
+	config, err := decodeConfig(images[0])
+	if err != nil {
+		return 0, err
+	}
+
+	input := int64(config.Width) * int64(config.Height)
+	working := int64(float64(input) * scale * scale)
+
+	perFrame := 4*input + 12*working
+	if scale != 1 {
+		perFrame += 4 * working
+	}
+
+	return int64(len(images))*perFrame + 4*working, nil
+}
+
+func decodeConfig(name string) (image.Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+
+	return config, err
+}
+
+// stagedFrame is a decoded frame written to disk as raw NRGBA rows, so the merge can read any strip of it without decoding the image again.
+type stagedFrame struct {
+	path   string
+	bounds image.Rectangle
+
+	// Applied to every strip read on workers goroutines, nil leaves them as is.
+	correction *PhotometricCorrection
+	workers    int
+}
+
+func stageFrame(img image.Image, path string) (stagedFrame, error) {
+	nrgba := imaging.Clone(img)
+	if err := ioutil.WriteFile(path, nrgba.Pix, 0600); err != nil {
+		return stagedFrame{}, err
+	}
+
+	return stagedFrame{path: path, bounds: nrgba.Bounds()}, nil
+}
+
+// strip reads the rows from minY to maxY of the frame, clipped to its bounds.
+func (sf stagedFrame) strip(minY, maxY int) (*Frame, error) {
+	img := image.NewNRGBA(image.Rect(sf.bounds.Min.X, minY, sf.bounds.Max.X, maxY).Intersect(sf.bounds))
+	if img.Rect.Empty() {
+		return NewFrame(img), nil
+	}
+
+	f, err := os.Open(sf.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.ReadAt(img.Pix, int64(img.Rect.Min.Y-sf.bounds.Min.Y)*int64(img.Stride)); err != nil {
+		return nil, err
+	}
+
+	if sf.correction != nil {
+		return NewFrame(sf.correction.Apply(img, sf.workers)), nil
+	}
+
+	return NewFrame(img), nil
+}
+
+// streamMerge merges the frames in strips of output rows, keeping only the strips of the frames the current rows need in memory, within about limit bytes.
+// The frames are decoded once into a temporary directory, and registered on proxies downscaled to fit the limit.
+// Unlike the in-memory merge, the frames are not upscaled first, they are interpolated directly at the working resolution.
+// With runningSums every frame strip is added to the sums of the output and dropped, instead of keeping the strips of every frame for the merge.
+// It returns the merged image at the working resolution.
+func (o *Options) streamMerge(ctx context.Context, images []string, colorMergeMethod ColorMerge, interpolate Interpolator, runningSums bool) (*Result, error) {
+	limit := o.MemoryLimit
+	dir, err := ioutil.TempDir("", "superres")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := decodeConfig(images[0])
+	if err != nil {
+		return nil, err
+	}
+	inputBounds := image.Rect(0, 0, config.Width, config.Height)
+
+	// The proxies get a quarter of the memory.
+	pixels := int64(len(images)) * int64(inputBounds.Dx()) * int64(inputBounds.Dy()) * frameBytesPerPixel
+	proxyWidth := int(math.Max(1, math.Round(float64(inputBounds.Dx())*math.Min(1, math.Sqrt(float64(limit)/4/float64(pixels))))))
+	proxyHeight := int(math.Max(1, math.Round(float64(inputBounds.Dy())*float64(proxyWidth)/float64(inputBounds.Dx()))))
+	proxyScale := float64(proxyWidth) / float64(inputBounds.Dx())
+
+	staged := make([]stagedFrame, len(images))
+	proxies := make([]image.Image, len(images))
+	progress := o.startStage(StageLoad, len(images), 0)
+	for i := range images {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		img, err := loadImage(images[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkFrameSize(images, i, img, inputBounds.Size()); err != nil {
+			return nil, err
+		}
+
+		if staged[i], err = stageFrame(img, filepath.Join(dir, strconv.Itoa(i)+".raw")); err != nil {
+			return nil, err
+		}
+
+		proxies[i] = img
+		if proxyScale != 1 {
+			proxies[i] = imaging.Resize(img, proxyWidth, proxyHeight, imaging.Box)
+		}
+		progress.addFrames(1)
+	}
+	o.verbosef("Registering the frames on %dx%d proxies\n", proxyWidth, proxyHeight)
+
+	referenceIndex, err := o.selectReference(images, proxies)
+	if err != nil {
+		return nil, err
+	}
+
+	o.moveReferenceFirst(images, referenceIndex, staged, proxies)
+
+	res := &Result{Stats: Stats{InputBounds: inputBounds, Streamed: true}}
+
+	// The corrections are estimated on the proxies, and applied to the strips as they are read.
+	if o.Normalize {
+		corrections, err := o.normalizePhotometric(ctx, images, proxies)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Stats.Corrections = make([]PhotometricCorrection, len(corrections))
+		for i := range staged {
+			staged[i].correction = &corrections[i]
+			staged[i].workers = o.workers()
+			res.Stats.Corrections[inputIndex(referenceIndex, i)] = corrections[i]
+		}
+	}
+
+	motionCorrection, cached, err := o.getMotionCorrection(ctx, images, NewFrames(proxies, o.workers()), referenceIndex, proxyScale)
+	if err != nil {
+		return nil, err
+	}
+	res.Stats.CachedMotions = cached
+
+	kept := o.framesToMerge(images, motionCorrection)
+	res.setRegistration(referenceIndex, motionCorrection, kept)
+	keptStaged := make([]stagedFrame, len(kept))
+	keptMotion := make([]Motion, len(kept))
+	for i, k := range kept {
+		keptStaged[i], keptMotion[i] = staged[k], motionCorrection[k]
+	}
+
+	working := image.Rect(0, 0, int(math.Round(float64(inputBounds.Dx())*o.Scale)), int(math.Round(float64(inputBounds.Dy())*o.Scale)))
+	rows := streamRows(limit, working, inputBounds, len(kept), o.Scale, runningSums)
+	o.verbosef("Merging %d rows at once\n", rows)
+
+	progress = o.startStage(StageMerge, 0, int64(working.Dx())*int64(working.Dy()))
+	if res.Image, err = streamStrips(ctx, keptStaged, keptMotion, working, rows, o.Scale, colorMergeMethod, interpolate, runningSums, o.workers(), progress); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// streamRows returns how many output rows fit in the memory limit at once, next to the output image.
+func streamRows(limit int64, working, input image.Rectangle, frames int, scale float64, runningSums bool) int {
+	held := int64(frames)
+	var perRow int64
+	if runningSums {
+		// The sums and the counts of the strip.
+		held = 1
+		perRow = int64(working.Dx()) * 32
+	}
+
+	// Every output row needs 1/scale rows of every frame held at once.
+	perRow += int64(math.Ceil(float64(held*int64(input.Dx())*frameBytesPerPixel) / scale))
+
+	rows := int((limit - 4*int64(working.Dx())*int64(working.Dy())) / perRow)
+	if rows < minStreamRows {
+		return minStreamRows
+	}
+
+	return rows
+}
+
+// streamStrips merges the staged frames onto the working bounds, rows output rows at a time.
+// The working resolution is scale times the input, the motions are in input pixels.
+// It reports the pixels of every merged strip, and returns the error of the context once it is canceled.
+func streamStrips(ctx context.Context, staged []stagedFrame, motionCorrection []Motion, working image.Rectangle, rows int, scale float64, colorMergeMethod ColorMerge, interpolate Interpolator, runningSums bool, workers int, progress *progressTracker) (*image.NRGBA, error) {
+	output := image.NewNRGBA(working)
+	motions := scaleMotions(motionCorrection, scale)
+
+	for y := working.Min.Y; y < working.Max.Y; y += rows {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		strip := image.Rect(working.Min.X, y, working.Max.X, y+rows).Intersect(working)
+
+		if runningSums {
+			sums := make([]LabColor, strip.Dx()*strip.Dy())
+			counts := make([]int, strip.Dx()*strip.Dy())
+			for k := range staged {
+				f, err := staged[k].strip(inputRows(motions[k], strip, scale))
+				if err != nil {
+					return nil, err
+				}
+
+				parallelRows(workers, strip, func(y int) {
+					for x := strip.Min.X; x < strip.Max.X; x++ {
+						if c, ok := streamSample(f, motions[k], working, x, y, scale, interpolate); ok {
+							i := (y-strip.Min.Y)*strip.Dx() + x - strip.Min.X
+							sums[i].L += c.L
+							sums[i].A += c.A
+							sums[i].B += c.B
+							counts[i]++
+						}
+					}
+				})
+			}
+
+			parallelRows(workers, strip, func(y int) {
+				for x := strip.Min.X; x < strip.Max.X; x++ {
+					i := (y-strip.Min.Y)*strip.Dx() + x - strip.Min.X
+					c := float64(counts[i])
+					output.Set(x, y, LabColor{L: sums[i].L / c, A: sums[i].A / c, B: sums[i].B / c}.Color())
+				}
+			})
+			progress.addPixels(int64(strip.Dx() * strip.Dy()))
+			continue
+		}
+
+		frames := make([]*Frame, len(staged))
+		for k := range staged {
+			var err error
+			if frames[k], err = staged[k].strip(inputRows(motions[k], strip, scale)); err != nil {
+				return nil, err
+			}
+		}
+
+		parallelRows(workers, strip, func(y int) {
+			currentColor := make([]LabColor, 0, len(frames))
+			for x := strip.Min.X; x < strip.Max.X; x++ {
+				currentColor = currentColor[:0]
+				for k := range frames {
+					if c, ok := streamSample(frames[k], motions[k], working, x, y, scale, interpolate); ok {
+						currentColor = append(currentColor, c)
+					}
+				}
+				output.Set(x, y, colorMergeMethod(currentColor).Color())
+			}
+		})
+		progress.addPixels(int64(strip.Dx() * strip.Dy()))
+	}
+
+	return output, nil
+}
+
+// streamSample returns the color of the frame at the output pixel, or false if the motion (in working pixels) moves it out of the frame.
+func streamSample(f *Frame, m Motion, working image.Rectangle, x, y int, scale float64, interpolate Interpolator) (LabColor, bool) {
+	currX, currY := m.Apply(float64(x), float64(y))
+	if currX < float64(working.Min.X) || currX > float64(working.Max.X-1) ||
+		currY < float64(working.Min.Y) || currY > float64(working.Max.Y-1) || f.Rect.Empty() {
+		return LabColor{}, false
+	}
+
+	// Position in the input frame, aligning the pixel centers.
+	return interpolate(f, (currX+0.5)/scale-0.5, (currY+0.5)/scale-0.5), true
+}
+
+// inputRows returns the rows of the input frame the strip of the output maps to through the motion (in working pixels), with a margin for the interpolation.
+func inputRows(m Motion, strip image.Rectangle, scale float64) (int, int) {
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, y := range gridPoints(strip.Min.Y, strip.Max.Y) {
+		for _, x := range gridPoints(strip.Min.X, strip.Max.X) {
+			_, currY := m.Apply(float64(x), float64(y))
+			currY = (currY+0.5)/scale - 0.5
+			minY, maxY = math.Min(minY, currY), math.Max(maxY, currY)
+		}
+	}
+
+	return int(math.Floor(minY)) - streamRowMargin, int(math.Ceil(maxY)) + streamRowMargin + 1
+}
+
+// gridPoints returns the points from min to max-1 every streamGridStep, always including max-1.
+func gridPoints(min, max int) []int {
+	var points []int
+	for p := min; p < max-1; p += streamGridStep {
+		points = append(points, p)
+	}
+
+	return append(points, max-1)
+}
@@ -0,0 +1,119 @@
+package superres
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// texture returns a colorful pattern shifted by (dx, dy).
+func texture(bounds image.Rectangle, dx, dy float64) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			fx, fy := float64(x)-dx, float64(y)-dy
+			img.Set(x, y, color.NRGBA{
+				R: uint8(127 + 120*math.Sin(fx/7)*math.Cos(fy/11)),
+				G: uint8(127 + 120*math.Cos(fy/5)),
+				B: uint8(127 + 120*math.Sin((fx+fy)/13)),
+				A: 255,
+			})
+		}
+	}
+
+	return img
+}
+
+func TestStreamStripsIdentical(t *testing.T) {
+	bounds := image.Rect(0, 0, 90, 70)
+	rotation := normalizedTransform("euclidean", []float64{0, 0, 0.02}, bounds)
+	motions := []Motion{{}, {X: 3, Y: -2, SubX: 0.25}, {Transform: &rotation}}
+
+	dir := t.TempDir()
+	images := make([]image.Image, len(motions))
+	staged := make([]stagedFrame, len(motions))
+	for i := range images {
+		images[i] = texture(bounds, float64(i), float64(2*i))
+
+		var err error
+		if staged[i], err = stageFrame(images[i], filepath.Join(dir, strconv.Itoa(i)+".raw")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"average", "median"} {
+		merge, _ := GetColorMerge(name, 0, 0, 0)
+		expected := superres(context.Background(), NewFrames(images, 3), motions, nil, merge, bilinearInterpolation, 3, nil)
+
+		output, err := streamStrips(context.Background(), staged, motions, bounds, minStreamRows, 1, merge, bilinearInterpolation, name == "average", 3, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(output.Pix, expected.Pix) {
+			t.Errorf("%s: streaming the merge in strips should be identical to the merge in memory", name)
+		}
+	}
+}
+
+func TestStreamMerge(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Sampler, opts.CacheMode = "uniform", "off"
+
+	bounds := image.Rect(0, 0, 256, 192)
+	dir := t.TempDir()
+	var images []string
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, strconv.Itoa(i)+".png")
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, texture(bounds, float64(3*i), float64(-3*i))); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		images = append(images, name)
+	}
+
+	footprint, err := inMemoryFootprint(images, opts.Scale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.MemoryLimit = footprint / 4
+
+	merge, _ := GetColorMerge("median", 0, 0, 0)
+	res, err := opts.streamMerge(context.Background(), images, merge, bilinearInterpolation, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, inputBounds := res.Image, res.Stats.InputBounds
+	if inputBounds != bounds || output.Bounds().Dx() != 512 || output.Bounds().Dy() != 384 {
+		t.Fatalf("Expected a 512x384 output of 256x192 inputs, got %v of %v", output.Bounds(), inputBounds)
+	}
+
+	// The aligned frames should merge into the reference, away from the edges where the frames don't overlap.
+	ref := NewFrame(texture(bounds, 0, 0))
+	var diff float64
+	var n int
+	for y := 40; y < 344; y++ {
+		for x := 40; x < 472; x++ {
+			expected := bilinearInterpolation(ref, (float64(x)+0.5)/2-0.5, (float64(y)+0.5)/2-0.5).Color()
+			got := rgbaToColorful(output.At(x, y))
+			diff += math.Abs(expected.R-got.R) + math.Abs(expected.G-got.G) + math.Abs(expected.B-got.B)
+			n += 3
+		}
+	}
+
+	if diff/float64(n) > 0.02 {
+		t.Errorf("Streamed merge should match the reference, mean difference %f", diff/float64(n))
+	}
+}
@@ -0,0 +1,229 @@
+package superres
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/Coornail/superres/sampler"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Motion search radius in pixels of every tile around the global motion of the frame.
+	tileSearchRadius = 8
+
+	// Number of samples compared in every tile.
+	tileSamples = 256
+
+	// A tile only gets its own motion if it matches at most this fraction of the distance of the global motion on the tile,
+	// and of the distance of its neighbouring motions. Tiles without detail match about as well anywhere, the best of their search is noise.
+	tileMinImprovement = 0.5
+
+	// Smallest tile size, smaller tiles hold too little detail to be told apart within the search radius.
+	minTileSize = 2 * tileSearchRadius
+
+	// Displacement in pixels that saturates a channel in the debug image of the displacement field.
+	tileDebugRange = 16.0
+)
+
+// DisplacementField holds the motion of overlapping tiles of the reference image, relative to the global motion of the frame.
+// Neighbouring tiles overlap by half of their size, and the motion between the tile centers is bilinearly interpolated.
+type DisplacementField struct {
+	TileSize int
+	Columns  int
+	Rows     int
+	Bounds   image.Rectangle
+
+	// Motions of the tiles on top of the global motion, in row-major order.
+	Motions []Motion
+
+	// Scale of the image the field is applied to, relative to the image it was estimated on (@see Motion.Scale).
+	Scale float64 `json:",omitempty"`
+}
+
+func (df *DisplacementField) step() int {
+	return df.TileSize / 2
+}
+
+func (df *DisplacementField) scale() float64 {
+	if df.Scale == 0 {
+		return 1
+	}
+
+	return df.Scale
+}
+
+// Tile returns the rectangle of the tile, clipped to the image.
+func (df *DisplacementField) Tile(column, row int) image.Rectangle {
+	origin := df.Bounds.Min.Add(image.Pt(column*df.step(), row*df.step()))
+
+	return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(df.TileSize, df.TileSize))}.Intersect(df.Bounds)
+}
+
+// Offset returns the interpolated motion at (x, y) of the reference image, on top of the global motion.
+func (df *DisplacementField) Offset(x, y float64) (float64, float64) {
+	if scale := df.scale(); scale != 1 {
+		shift := (scale - 1) / 2
+		motionX, motionY := df.offset((x-shift)/scale, (y-shift)/scale)
+		return motionX * scale, motionY * scale
+	}
+
+	return df.offset(x, y)
+}
+
+func (df *DisplacementField) offset(x, y float64) (float64, float64) {
+	// Position in the grid of the tile centers.
+	step := float64(df.step())
+	gx := (x - float64(df.Bounds.Min.X) - float64(df.TileSize)/2) / step
+	gy := (y - float64(df.Bounds.Min.Y) - float64(df.TileSize)/2) / step
+
+	gx = math.Max(0, math.Min(float64(df.Columns-1), gx))
+	gy = math.Max(0, math.Min(float64(df.Rows-1), gy))
+
+	column, row := int(gx), int(gy)
+	fx, fy := gx-float64(column), gy-float64(row)
+
+	nextColumn, nextRow := column+1, row+1
+	if nextColumn >= df.Columns {
+		nextColumn = column
+	}
+	if nextRow >= df.Rows {
+		nextRow = row
+	}
+
+	x00, y00 := df.Motions[row*df.Columns+column].Offset()
+	x10, y10 := df.Motions[row*df.Columns+nextColumn].Offset()
+	x01, y01 := df.Motions[nextRow*df.Columns+column].Offset()
+	x11, y11 := df.Motions[nextRow*df.Columns+nextColumn].Offset()
+
+	return lerp(lerp(x00, x10, fx), lerp(x01, x11, fx), fy), lerp(lerp(y00, y10, fx), lerp(y01, y11, fx), fy)
+}
+
+// estimateTiles estimates the motion of every tile of the reference on top of the global motion of the frame, including its transform.
+// Tiles without enough detail to improve on the global motion keep it.
+func (o *Options) estimateTiles(reference, candidate image.Image, m Motion) *DisplacementField {
+	tileSize := o.TileSize
+	bounds := reference.Bounds()
+	ref, cand := asFrame(reference), asFrame(candidate)
+	step := tileSize / 2
+
+	df := &DisplacementField{
+		TileSize: tileSize,
+		Columns:  tileCount(bounds.Dx(), tileSize, step),
+		Rows:     tileCount(bounds.Dy(), tileSize, step),
+		Bounds:   bounds,
+	}
+	df.Motions = make([]Motion, df.Columns*df.Rows)
+
+	global := m
+	global.Tiles = nil
+
+	for row := 0; row < df.Rows; row++ {
+		for column := 0; column < df.Columns; column++ {
+			tile := df.Tile(column, row)
+			smp := sampler.NewOffsetSampler(o.imageSampler(imaging.Crop(ref, tile), tileSamples), tile.Min)
+
+			distance := func(xMotion, yMotion int) (float64, int) {
+				return residualDistance(ref, cand, smp, global, float64(xMotion), float64(yMotion))
+			}
+
+			globalDiff, _ := distance(0, 0)
+			residual := spiral(0, 0, tileSearchRadius, distance)
+			if residual.Diff < globalDiff*tileMinImprovement && distinctMinimum(residual, distance) {
+				residual = refine(residual, distance)
+			} else {
+				residual = Motion{Diff: globalDiff}
+			}
+
+			df.Motions[row*df.Columns+column] = residual
+		}
+	}
+
+	return df
+}
+
+// distinctMinimum tells whether the neighbouring motions are clearly worse than the motion, so it is a match rather than noise.
+func distinctMinimum(m Motion, distance distanceFunc) bool {
+	for _, d := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		if dist, _ := distance(m.X+d.X, m.Y+d.Y); m.Diff >= dist*tileMinImprovement {
+			return false
+		}
+	}
+
+	return true
+}
+
+// residualDistance is the mean square color difference between the reference and the candidate moved by the global motion and the residual.
+func residualDistance(ref, candidate *Frame, smp sampler.ImageSampler, global Motion, residualX, residualY float64) (float64, int) {
+	bounds := candidate.Rect
+
+	var dist float64
+	numberOfPixelsCompared := 0
+
+	smp.Reset()
+	for smp.HasMore() {
+		x, y := smp.Next()
+		if !image.Pt(x, y).In(ref.Rect) {
+			continue
+		}
+
+		cx, cy := global.Apply(float64(x), float64(y))
+		cx, cy = cx+residualX, cy+residualY
+		if cx < float64(bounds.Min.X) || cx > float64(bounds.Max.X-1) ||
+			cy < float64(bounds.Min.Y) || cy > float64(bounds.Max.Y-1) {
+			continue
+		}
+
+		l, a, b := ref.Lab(x, y)
+		d := LabColor{L: l, A: a, B: b}.distance(bilinearInterpolation(candidate, cx, cy))
+		dist += d * d
+		numberOfPixelsCompared++
+	}
+
+	if numberOfPixelsCompared == 0 {
+		return math.MaxFloat64, 0
+	}
+
+	return dist / float64(numberOfPixelsCompared), numberOfPixelsCompared
+}
+
+// tileCount returns how many tiles of the given size and step are needed to cover the length.
+func tileCount(length, tileSize, step int) int {
+	if length <= tileSize || step <= 0 {
+		return 1
+	}
+
+	return int(math.Ceil(float64(length-tileSize)/float64(step))) + 1
+}
+
+// WriteToFile renders the displacement field, one block per tile.
+// Red is the horizontal and green is the vertical displacement, mid-gray means no difference from the global motion.
+func (df *DisplacementField) WriteToFile(filename string) error {
+	img := image.NewNRGBA(image.Rect(0, 0, df.Columns, df.Rows))
+	for row := 0; row < df.Rows; row++ {
+		for column := 0; column < df.Columns; column++ {
+			x, y := df.Motions[row*df.Columns+column].Offset()
+			img.Set(column, row, color.NRGBA{
+				R: displacementChannel(x),
+				G: displacementChannel(y),
+				B: 128,
+				A: 255,
+			})
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return png.Encode(f, imaging.Resize(img, df.Bounds.Dx(), df.Bounds.Dy(), imaging.NearestNeighbor))
+}
+
+func displacementChannel(d float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, 128+d*127/tileDebugRange)))
+}
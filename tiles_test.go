@@ -0,0 +1,103 @@
+package superres
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTileCount(t *testing.T) {
+	if c := tileCount(1920, 256, 128); c != 14 {
+		t.Errorf("Expected 14 tiles, got %d", c)
+	}
+
+	if c := tileCount(100, 256, 128); c != 1 {
+		t.Errorf("Image smaller than a tile should have a single tile, got %d", c)
+	}
+}
+
+func TestEstimateTiles(t *testing.T) {
+	bounds := image.Rect(0, 0, 256, 128)
+	pattern := func(x, y int) color.Color {
+		v := 0.5 + 0.25*math.Sin(float64(x)/7) + 0.25*math.Cos(float64(y)/9)
+		return color.Gray{Y: uint8(v * 255)}
+	}
+
+	// The left half of the candidate moves by (2, 1), the right half by (5, -3).
+	reference := image.NewNRGBA(bounds)
+	candidate := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			reference.Set(x, y, pattern(x, y))
+			if x < bounds.Dx()/2 {
+				candidate.Set(x, y, pattern(x-2, y-1))
+			} else {
+				candidate.Set(x, y, pattern(x-5, y+3))
+			}
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.TileSize = 64
+	m := Motion{X: 2, Y: 1}
+	m.Tiles = opts.estimateTiles(reference, candidate, m)
+
+	if x, y := m.Tiles.Offset(48, 64); math.Abs(x) > 0.5 || math.Abs(y) > 0.5 {
+		t.Errorf("The left half should keep the global motion, got a residual of %f %f", x, y)
+	}
+
+	if x, y := m.Apply(48, 64); math.Abs(x-50) > 0.5 || math.Abs(y-65) > 0.5 {
+		t.Errorf("Wrong motion for the left half: %f %f", x, y)
+	}
+
+	if x, y := m.Apply(208, 64); math.Abs(x-213) > 0.5 || math.Abs(y-61) > 0.5 {
+		t.Errorf("Wrong motion for the right half: %f %f", x, y)
+	}
+}
+
+func TestEstimateTilesFlat(t *testing.T) {
+	// The pattern only covers the left half, the right half is flat with a little noise.
+	bounds := image.Rect(0, 0, 256, 128)
+	rnd := rand.New(rand.NewSource(1))
+	reference := texture(bounds, 0, 0)
+	candidate := texture(bounds, 3, 2)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Dx() / 2; x < bounds.Max.X; x++ {
+			reference.Set(x, y, color.Gray{Y: uint8(128 + rnd.Intn(3))})
+			candidate.Set(x, y, color.Gray{Y: uint8(128 + rnd.Intn(3))})
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.TileSize = 64
+	global := Motion{X: 3, Y: 2}
+	df := opts.estimateTiles(reference, candidate, global)
+
+	for row := 0; row < df.Rows; row++ {
+		x, y := df.Motions[row*df.Columns+df.Columns-1].Offset()
+		if x != 0 || y != 0 {
+			t.Errorf("A flat tile should keep the global motion, got a residual of %f %f", x, y)
+		}
+	}
+}
+
+func TestMotionApplyTilesOnTransform(t *testing.T) {
+	bounds := image.Rect(0, 0, 128, 128)
+	rotation := normalizedTransform("euclidean", []float64{1, 2, 0.05}, bounds)
+	df := &DisplacementField{TileSize: 128, Columns: 1, Rows: 1, Bounds: bounds, Motions: []Motion{{X: 1, SubY: -0.5}}}
+	m := Motion{X: 1, Y: 2, Transform: &rotation, Tiles: df}
+
+	for _, p := range [][2]float64{{10, 20}, {100, 90}} {
+		rx, ry := rotation.Apply(p[0], p[1])
+		x, y := m.Apply(p[0], p[1])
+		if math.Abs(x-(rx+1)) > 1e-9 || math.Abs(y-(ry-0.5)) > 1e-9 {
+			t.Errorf("The tiles should refine the transform at %v, expected %f %f, got %f %f", p, rx+1, ry-0.5, x, y)
+		}
+
+		if ix, iy := m.Inverse(x, y); math.Abs(ix-p[0]) > 1e-6 || math.Abs(iy-p[1]) > 1e-6 {
+			t.Errorf("The inverse should go back to %v, got %f %f", p, ix, iy)
+		}
+	}
+}
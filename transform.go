@@ -0,0 +1,240 @@
+package superres
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/Coornail/superres/sampler"
+)
+
+// Transform maps a point of the reference image to the candidate image.
+// Matrix is a row-major homography in pixel coordinates, every supported model is a special case of it.
+type Transform struct {
+	Model  string
+	Matrix [9]float64
+}
+
+const (
+	// Upper limit of the pattern search iterations when estimating a transform.
+	maxTransformIterations = 200
+
+	// The pattern search starts with steps moving the image corners by this many pixels.
+	initialTransformStep = 8.0
+
+	// The pattern search stops when the step size gets smaller than this many pixels.
+	minTransformStep = 0.01
+
+	// Smallest magnitude of the last element of the inverse matrix it gets normalized by.
+	transformEpsilon = 1e-12
+)
+
+// TransformModels lists the supported transform models, from the most to the least constrained.
+var TransformModels = []string{"translation", "euclidean", "similarity", "affine", "homography"}
+
+// Apply returns the position of (x, y) in the candidate image.
+func (t Transform) Apply(x, y float64) (float64, float64) {
+	m := t.Matrix
+	w := m[6]*x + m[7]*y + m[8]
+
+	return (m[0]*x + m[1]*y + m[2]) / w, (m[3]*x + m[4]*y + m[5]) / w
+}
+
+// Inverse returns the transform mapping the candidate image back to the reference image.
+func (t Transform) Inverse() Transform {
+	m := t.Matrix
+	inverse := [9]float64{
+		m[4]*m[8] - m[5]*m[7], m[2]*m[7] - m[1]*m[8], m[1]*m[5] - m[2]*m[4],
+		m[5]*m[6] - m[3]*m[8], m[0]*m[8] - m[2]*m[6], m[2]*m[3] - m[0]*m[5],
+		m[3]*m[7] - m[4]*m[6], m[1]*m[6] - m[0]*m[7], m[0]*m[4] - m[1]*m[3],
+	}
+
+	// The homography is only defined up to scale, so the adjugate is enough; we normalize it to keep the numbers readable.
+	// An inverse mapping the origin to infinity can't be normalized, the adjugate is kept as is.
+	if math.Abs(inverse[8]) > transformEpsilon {
+		for i := range inverse {
+			inverse[i] /= inverse[8]
+		}
+	}
+
+	return Transform{Model: t.Model, Matrix: inverse}
+}
+
+func (t Transform) String() string {
+	m := t.Matrix
+	return fmt.Sprintf("%s [%.5f %.5f %.3f; %.5f %.5f %.3f; %.7f %.7f %.3f]", t.Model, m[0], m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[8])
+}
+
+// transformParameters returns the number of free parameters of the model.
+func transformParameters(model string) (int, error) {
+	switch model {
+	case "translation":
+		return 2, nil
+	case "euclidean":
+		return 3, nil
+	case "similarity":
+		return 4, nil
+	case "affine":
+		return 6, nil
+	case "homography":
+		return 8, nil
+	default:
+		return 0, fmt.Errorf("unknown transform model %q, valid models: %v", model, TransformModels)
+	}
+}
+
+// normalizedTransform builds the transform from its parameters.
+// The parameters are expressed in coordinates centered on the image and scaled by its half diagonal, so every parameter has a similar effect on the pixels.
+// The first two parameters are always the translation.
+func normalizedTransform(model string, params []float64, bounds image.Rectangle) Transform {
+	h := [9]float64{1, 0, params[0], 0, 1, params[1], 0, 0, 1}
+
+	switch model {
+	case "euclidean", "similarity":
+		scale := 1.0
+		if model == "similarity" {
+			scale += params[3]
+		}
+		sin, cos := math.Sincos(params[2])
+		h[0], h[1] = scale*cos, -scale*sin
+		h[3], h[4] = scale*sin, scale*cos
+	case "affine", "homography":
+		h[0] += params[2]
+		h[1] = params[3]
+		h[3] = params[4]
+		h[4] += params[5]
+		if model == "homography" {
+			h[6], h[7] = params[6], params[7]
+		}
+	}
+
+	cx, cy, norm := normalization(bounds)
+	toNormalized := [9]float64{1 / norm, 0, -cx / norm, 0, 1 / norm, -cy / norm, 0, 0, 1}
+	fromNormalized := [9]float64{norm, 0, cx, 0, norm, cy, 0, 0, 1}
+
+	return Transform{Model: model, Matrix: multiplyMatrix(fromNormalized, multiplyMatrix(h, toNormalized))}
+}
+
+func normalization(bounds image.Rectangle) (cx, cy, norm float64) {
+	cx = float64(bounds.Min.X+bounds.Max.X) / 2
+	cy = float64(bounds.Min.Y+bounds.Max.Y) / 2
+	norm = math.Hypot(float64(bounds.Dx()), float64(bounds.Dy())) / 2
+
+	return cx, cy, norm
+}
+
+func multiplyMatrix(a, b [9]float64) [9]float64 {
+	var res [9]float64
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				res[row*3+col] += a[row*3+k] * b[k*3+col]
+			}
+		}
+	}
+
+	return res
+}
+
+// estimateTransform refines the translation found by estimateMotion to the given transform model.
+// It runs a Hooke-Jeeves pattern search over the model parameters, halving the step size once no direction improves.
+func estimateTransform(reference, candidate image.Image, m Motion, model string) (Motion, error) {
+	parameters, err := transformParameters(model)
+	if err != nil || model == "translation" {
+		return m, err
+	}
+
+	bounds := reference.Bounds()
+	ref, cand := asFrame(reference), asFrame(candidate)
+	// Rotation and scaling barely move the pixels around the center, so we need samples spread over the whole image.
+	smp := sampler.NewUniformSampler(ref, ImageSamples)
+
+	_, _, norm := normalization(bounds)
+	params := make([]float64, parameters)
+	params[0], params[1] = m.Offset()
+	params[0] /= norm
+	params[1] /= norm
+
+	cost := func(params []float64) float64 {
+		return transformDistance(ref, cand, smp, normalizedTransform(model, params, bounds))
+	}
+
+	best := cost(params)
+	step := initialTransformStep / norm
+	for i := 0; i < maxTransformIterations && step*norm >= minTransformStep; i++ {
+		explored, exploredDist := exploreTransform(params, best, step, cost)
+		if exploredDist >= best {
+			step /= 2
+			continue
+		}
+
+		// Keep moving in the direction that improved, as long as it does.
+		for exploredDist < best && i < maxTransformIterations {
+			pattern := make([]float64, len(params))
+			for p := range params {
+				pattern[p] = 2*explored[p] - params[p]
+			}
+			params, best = explored, exploredDist
+			explored, exploredDist = exploreTransform(pattern, cost(pattern), step, cost)
+			i++
+		}
+	}
+
+	t := normalizedTransform(model, params, bounds)
+	m.Transform = &t
+	m.Diff = best
+
+	return m, nil
+}
+
+// exploreTransform nudges every parameter in both directions by step and keeps the changes that decrease the cost.
+func exploreTransform(params []float64, dist, step float64, cost func([]float64) float64) ([]float64, float64) {
+	explored := make([]float64, len(params))
+	copy(explored, params)
+
+	for p := range explored {
+		for _, direction := range []float64{1, -1} {
+			explored[p] += direction * step
+			if d := cost(explored); d < dist {
+				dist = d
+				break
+			}
+			explored[p] -= direction * step
+		}
+	}
+
+	return explored, dist
+}
+
+// transformDistance is the mean square color difference between the reference and the candidate warped by the transform.
+func transformDistance(ref, candidate *Frame, smp sampler.ImageSampler, t Transform) float64 {
+	bounds := candidate.Rect
+
+	var dist float64
+	numberOfPixelsCompared := 0
+
+	smp.Reset()
+	for smp.HasMore() {
+		x, y := smp.Next()
+		if !image.Pt(x, y).In(ref.Rect) {
+			continue
+		}
+
+		cx, cy := t.Apply(float64(x), float64(y))
+		if cx < float64(bounds.Min.X) || cx > float64(bounds.Max.X-1) ||
+			cy < float64(bounds.Min.Y) || cy > float64(bounds.Max.Y-1) {
+			continue
+		}
+
+		l, a, b := ref.Lab(x, y)
+		d := LabColor{L: l, A: a, B: b}.distance(bilinearInterpolation(candidate, cx, cy))
+		dist += d * d
+		numberOfPixelsCompared++
+	}
+
+	if numberOfPixelsCompared == 0 {
+		return math.MaxFloat64
+	}
+
+	return dist / float64(numberOfPixelsCompared)
+}
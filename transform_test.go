@@ -0,0 +1,84 @@
+package superres
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestNormalizedTranslation(t *testing.T) {
+	bounds := image.Rect(0, 0, 1920, 1080)
+	_, _, norm := normalization(bounds)
+
+	for _, model := range TransformModels {
+		n, _ := transformParameters(model)
+		params := make([]float64, n)
+		params[0], params[1] = 3/norm, -2/norm
+
+		x, y := normalizedTransform(model, params, bounds).Apply(100, 200)
+		if math.Abs(x-103) > 1e-9 || math.Abs(y-198) > 1e-9 {
+			t.Errorf("%s: translation parameters should only translate, got %f %f", model, x, y)
+		}
+	}
+}
+
+func TestInverseHomography(t *testing.T) {
+	// The inverse maps the origin to infinity, so its last element is zero.
+	h := Transform{Model: "homography", Matrix: [9]float64{1, 0, 0, 0, 0, 1, 0, 1, 0}}
+	inverse := h.Inverse()
+	for _, v := range inverse.Matrix {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Fatalf("The inverse should stay finite, got %s", inverse)
+		}
+	}
+
+	x, y := inverse.Apply(h.Apply(2, 4))
+	if math.Abs(x-2) > 1e-9 || math.Abs(y-4) > 1e-9 {
+		t.Errorf("The inverse should map the point back, got %f %f", x, y)
+	}
+}
+
+func TestUnknownTransformModel(t *testing.T) {
+	if _, err := estimateTransform(nil, nil, Motion{}, "perspective"); err == nil {
+		t.Errorf("Unknown transform model should return an error")
+	}
+}
+
+func TestEstimateSimilarity(t *testing.T) {
+	bounds := image.Rect(0, 0, 640, 480)
+	reference := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := 0.5 + 0.25*math.Sin(float64(x)/15) + 0.25*math.Cos(float64(y)/21)
+			reference.Set(x, y, color.Gray{Y: uint8(v * 255)})
+		}
+	}
+
+	// Warp the reference by a rotation of 1 degree and a 1% zoom.
+	_, _, norm := normalization(bounds)
+	warp := normalizedTransform("similarity", []float64{3 / norm, -2 / norm, math.Pi / 180, 0.01}, bounds)
+	referenceFrame := NewFrame(reference)
+	candidate := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			wx, wy := warp.Apply(float64(x), float64(y))
+			candidate.Set(x, y, bilinearInterpolation(referenceFrame, wx, wy).Color())
+		}
+	}
+
+	opts := DefaultOptions()
+	m, err := estimateTransform(reference, candidate, opts.estimateMotion(reference, candidate), "similarity")
+	if err != nil {
+		panic(err)
+	}
+
+	// The estimated transform should undo the warp.
+	for _, p := range []image.Point{{0, 0}, {639, 0}, {0, 479}, {639, 479}, {320, 240}} {
+		wx, wy := warp.Apply(float64(p.X), float64(p.Y))
+		x, y := m.Apply(wx, wy)
+		if math.Hypot(x-float64(p.X), y-float64(p.Y)) > 0.5 {
+			t.Errorf("Did not find the similarity transform, %v is mapped to %f %f (%s)", p, x, y, m.Transform)
+		}
+	}
+}